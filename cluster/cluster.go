@@ -0,0 +1,298 @@
+// Package cluster runs a NumberGenerator as a member of a Raft cluster. Appends
+// and status updates are committed through consensus before they are applied, so
+// a number is never issued twice or lost when the leader fails over.
+//
+// Three or five nodes tolerate the loss of one or two of them. Every node applies
+// the committed commands to its own generator; reads can be served from any node
+// but only reflect what that node has applied so far.
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"queueguard/numbergenerator"
+)
+
+// ErrNotLeader is returned by writes sent to a node that is not the leader.
+var ErrNotLeader = raft.ErrNotLeader
+
+// Peer is a voting member of the cluster.
+type Peer struct {
+	ID   string
+	Addr string
+}
+
+// Config configures a Node.
+type Config struct {
+	NodeID  string // Unique ID of the node within the cluster
+	DataDir string // Holds the raft log, its snapshots and the applied index
+
+	// BindAddr is the TCP address raft listens on, e.g. "127.0.0.1:7500". It is
+	// ignored when Transport is set.
+	BindAddr string
+
+	// Transport replaces the TCP transport, e.g. with raft.NewInmemTransport to run
+	// several nodes in one process.
+	Transport raft.Transport
+
+	// Bootstrap forms a new cluster out of Peers, or out of this node alone when
+	// Peers is empty. It is ignored when the node already has raft state. Exactly
+	// one node of a new cluster should bootstrap it; others join via AddVoter.
+	Bootstrap bool
+	Peers     []Peer
+
+	// InMemory keeps the raft log and snapshots in memory. Such a node cannot be
+	// restarted with its data and is meant for tests.
+	InMemory bool
+
+	ApplyTimeout time.Duration // How long writes wait for a commit, 10s by default
+	Raft         *raft.Config  // Base raft configuration, raft.DefaultConfig() when nil
+	LogOutput    io.Writer     // Raft's log output, os.Stderr by default
+}
+
+// Node is a NumberGenerator replicated through raft.
+type Node struct {
+	ng        *numbergenerator.NumberGenerator
+	raft      *raft.Raft
+	transport raft.Transport
+	closers   []io.Closer
+	timeout   time.Duration
+}
+
+// NewNode starts a cluster node applying committed commands to ng. The generator
+// must only be written through the node.
+func NewNode(ng *numbergenerator.NumberGenerator, cfg Config) (*Node, error) {
+	if cfg.NodeID == "" {
+		return nil, errors.New("cluster: NodeID is required")
+	}
+	if cfg.DataDir == "" {
+		return nil, errors.New("cluster: DataDir is required")
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = 10 * time.Second
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = os.Stderr
+	}
+
+	conf := raft.DefaultConfig()
+	if cfg.Raft != nil {
+		copied := *cfg.Raft
+		conf = &copied
+	}
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+	conf.LogOutput = cfg.LogOutput
+
+	n := &Node{ng: ng, timeout: cfg.ApplyTimeout}
+
+	var (
+		logs   raft.LogStore
+		stable raft.StableStore
+		snaps  raft.SnapshotStore
+	)
+	if cfg.InMemory {
+		store := raft.NewInmemStore()
+		logs, stable, snaps = store, store, raft.NewInmemSnapshotStore()
+	} else {
+		store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+		if err != nil {
+			return nil, err
+		}
+		n.closers = append(n.closers, store)
+		logs, stable = store, store
+
+		fileSnaps, err := raft.NewFileSnapshotStore(cfg.DataDir, 2, cfg.LogOutput)
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+		snaps = fileSnaps
+	}
+
+	n.transport = cfg.Transport
+	if n.transport == nil {
+		tcp, err := raft.NewTCPTransport(cfg.BindAddr, nil, 3, 10*time.Second, cfg.LogOutput)
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+		n.transport = tcp
+		n.closers = append(n.closers, tcp)
+	}
+
+	machine, err := newFSM(ng, cfg.DataDir)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+
+	if cfg.Bootstrap {
+		existing, err := raft.HasExistingState(logs, stable, snaps)
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+		if !existing {
+			servers := []raft.Server{{ID: conf.LocalID, Address: n.transport.LocalAddr()}}
+			if len(cfg.Peers) > 0 {
+				servers = servers[:0]
+				for _, peer := range cfg.Peers {
+					servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.Addr)})
+				}
+			}
+			err := raft.BootstrapCluster(conf, logs, stable, snaps, n.transport, raft.Configuration{Servers: servers})
+			if err != nil {
+				n.close()
+				return nil, err
+			}
+		}
+	}
+
+	n.raft, err = raft.NewRaft(conf, machine, logs, stable, snaps, n.transport)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// close releases the stores and the transport.
+func (n *Node) close() {
+	for _, closer := range n.closers {
+		closer.Close()
+	}
+}
+
+// Addr returns the raft address of the node, used to add it to a cluster.
+func (n *Node) Addr() string {
+	return string(n.transport.LocalAddr())
+}
+
+// IsLeader reports whether the node currently leads the cluster.
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the ID and address of the current leader, empty if unknown.
+func (n *Node) Leader() (id, addr string) {
+	address, serverID := n.raft.LeaderWithID()
+	return string(serverID), string(address)
+}
+
+// AppendRecord commits the append of a record to primaryKey and returns the
+// number it was assigned. It must be called on the leader.
+func (n *Node) AppendRecord(primaryKey string, status byte) (uint64, error) {
+	return n.appendRecord(primaryKey, "", status)
+}
+
+// AppendGroupRecord commits the append of a record to a message group of primaryKey.
+func (n *Node) AppendGroupRecord(primaryKey, groupID string, status byte) (uint64, error) {
+	return n.appendRecord(primaryKey, groupID, status)
+}
+
+func (n *Node) appendRecord(primaryKey, groupID string, status byte) (uint64, error) {
+	// The filename is chosen before the command is committed so that every node
+	// stores the same one.
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		return 0, err
+	}
+	return n.apply(numbergenerator.Mutation{
+		Type:     numbergenerator.MutationAppend,
+		Key:      primaryKey,
+		Group:    groupID,
+		Status:   status,
+		Filename: newUUID.String(),
+		Time:     time.Now(),
+	})
+}
+
+// UpdateStatuses commits marking numbers of primaryKey as done. It must be called
+// on the leader.
+func (n *Node) UpdateStatuses(primaryKey string, numbers []uint64) error {
+	return n.updateStatuses(primaryKey, "", numbers)
+}
+
+// UpdateGroupStatuses commits marking numbers of a message group of primaryKey as done.
+func (n *Node) UpdateGroupStatuses(primaryKey, groupID string, numbers []uint64) error {
+	return n.updateStatuses(primaryKey, groupID, numbers)
+}
+
+func (n *Node) updateStatuses(primaryKey, groupID string, numbers []uint64) error {
+	if len(numbers) == 0 {
+		return nil
+	}
+	_, err := n.apply(numbergenerator.Mutation{
+		Type:    numbergenerator.MutationUpdateStatuses,
+		Key:     primaryKey,
+		Group:   groupID,
+		Numbers: numbers,
+		Time:    time.Now(),
+	})
+	return err
+}
+
+func (n *Node) apply(m numbergenerator.Mutation) (uint64, error) {
+	cmd, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	future := n.raft.Apply(cmd, n.timeout)
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+	result := future.Response().(applyResult)
+	return result.number, result.err
+}
+
+// AddVoter adds a node to the cluster. It must be called on the leader; the new
+// node catches up from a snapshot and the log before it counts towards a majority.
+func (n *Node) AddVoter(id, addr string) error {
+	return n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, n.timeout).Error()
+}
+
+// RemoveServer removes a node from the cluster. It must be called on the leader.
+func (n *Node) RemoveServer(id string) error {
+	return n.raft.RemoveServer(raft.ServerID(id), 0, n.timeout).Error()
+}
+
+// Servers returns the current cluster membership.
+func (n *Node) Servers() ([]Peer, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, server := range future.Configuration().Servers {
+		peers = append(peers, Peer{ID: string(server.ID), Addr: string(server.Address)})
+	}
+	return peers, nil
+}
+
+// Snapshot takes a raft snapshot now, allowing the log before it to be compacted.
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+// Shutdown stops the node. The generator is left open.
+func (n *Node) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	n.close()
+	if err != nil {
+		return fmt.Errorf("cluster: shutting down: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"queueguard/numbergenerator"
+)
+
+// testNode is a cluster node running on an in-memory transport.
+type testNode struct {
+	*Node
+	ng        *numbergenerator.NumberGenerator
+	transport *raft.InmemTransport
+}
+
+func fastRaftConfig() *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.TrailingLogs = 5
+	conf.SnapshotThreshold = 1 << 30 // Snapshots are only taken explicitly
+	return conf
+}
+
+func startNode(t *testing.T, id string, bootstrap bool, peers []Peer) *testNode {
+	t.Helper()
+	ng, err := numbergenerator.NewNumberGenerator(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewNumberGenerator failed: %v", err)
+	}
+	t.Cleanup(func() { ng.Close() })
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	node, err := NewNode(ng, Config{
+		NodeID:    id,
+		DataDir:   t.TempDir(),
+		Transport: transport,
+		Bootstrap: bootstrap,
+		Peers:     peers,
+		InMemory:  true,
+		Raft:      fastRaftConfig(),
+		LogOutput: io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewNode %s failed: %v", id, err)
+	}
+	return &testNode{Node: node, ng: ng, transport: transport}
+}
+
+// connect makes every node reachable from every other.
+func connect(nodes ...*testNode) {
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.transport.Connect(b.transport.LocalAddr(), b.transport)
+			}
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForLeader(t *testing.T, nodes ...*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitFor(t, "a leader", func() bool {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func waitForLastNumber(t *testing.T, n *testNode, primaryKey string, want uint64) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s to apply %d records", n.Addr(), want), func() bool {
+		last, err := n.ng.GetLastNumber(primaryKey)
+		return err == nil && last == want
+	})
+}
+
+func TestClusterSurvivesLeaderFailure(t *testing.T) {
+	peers := []Peer{{ID: "n1", Addr: "n1"}, {ID: "n2", Addr: "n2"}, {ID: "n3", Addr: "n3"}}
+	nodes := []*testNode{
+		startNode(t, "n1", true, peers),
+		startNode(t, "n2", false, nil),
+		startNode(t, "n3", false, nil),
+	}
+	connect(nodes...)
+	defer func() {
+		for _, n := range nodes {
+			n.Shutdown()
+		}
+	}()
+
+	leader := waitForLeader(t, nodes...)
+	for want := uint64(1); want <= 5; want++ {
+		number, err := leader.AppendRecord("orders", 0)
+		if err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+		if number != want {
+			t.Fatalf("AppendRecord = %d, want %d", number, want)
+		}
+	}
+	if err := leader.UpdateStatuses("orders", []uint64{1, 2}); err != nil {
+		t.Fatalf("UpdateStatuses failed: %v", err)
+	}
+
+	for _, n := range nodes {
+		if n != leader {
+			if _, err := n.AppendRecord("orders", 0); err != ErrNotLeader {
+				t.Errorf("AppendRecord on a follower returned %v, want ErrNotLeader", err)
+			}
+		}
+	}
+
+	// Take the leader down; the survivors elect a new one that continues the sequence.
+	var survivors []*testNode
+	for _, n := range nodes {
+		if n == leader {
+			n.Shutdown()
+		} else {
+			survivors = append(survivors, n)
+		}
+	}
+	nodes = survivors
+
+	leader = waitForLeader(t, survivors...)
+	for want := uint64(6); want <= 8; want++ {
+		number, err := leader.AppendRecord("orders", 0)
+		if err != nil {
+			t.Fatalf("AppendRecord after failover failed: %v", err)
+		}
+		if number != want {
+			t.Fatalf("AppendRecord after failover = %d, want %d", number, want)
+		}
+	}
+
+	want, _ := leader.ng.GetFilename("orders", 7)
+	for _, n := range survivors {
+		waitForLastNumber(t, n, "orders", 8)
+		if last, err := n.ng.GetLastUpdateNumber("orders"); err != nil || last != 2 {
+			t.Errorf("GetLastUpdateNumber = %d, %v", last, err)
+		}
+		if got, _ := n.ng.GetFilename("orders", 7); got != want {
+			t.Errorf("filename %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNewVoterCatchesUpFromSnapshot(t *testing.T) {
+	first := startNode(t, "n1", true, nil)
+	defer first.Shutdown()
+	waitForLeader(t, first)
+
+	for i := 0; i < 20; i++ {
+		if _, err := first.AppendRecord("orders", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	if _, err := first.AppendGroupRecord("orders", "eu", 0); err != nil {
+		t.Fatalf("AppendGroupRecord failed: %v", err)
+	}
+	// Compact the log so the new node has to start from the snapshot.
+	if err := first.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	second := startNode(t, "n2", false, nil)
+	defer second.Shutdown()
+	connect(first, second)
+	if err := first.AddVoter("n2", second.Addr()); err != nil {
+		t.Fatalf("AddVoter failed: %v", err)
+	}
+	if _, err := first.AppendRecord("orders", 0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+
+	waitForLastNumber(t, second, "orders", 21)
+	group, _ := second.ng.Group("orders", "eu")
+	if last, err := group.GetLastNumber(); err != nil || last != 1 {
+		t.Errorf("group GetLastNumber = %d, %v", last, err)
+	}
+	servers, err := first.Servers()
+	if err != nil || len(servers) != 2 {
+		t.Errorf("Servers = %v, %v", servers, err)
+	}
+}
+
+func TestApplyStopsOnStorageErrors(t *testing.T) {
+	basePath := t.TempDir()
+	ng, err := numbergenerator.NewNumberGenerator(basePath)
+	if err != nil {
+		t.Fatalf("NewNumberGenerator failed: %v", err)
+	}
+	defer ng.Close()
+	f, err := newFSM(ng, t.TempDir())
+	if err != nil {
+		t.Fatalf("newFSM failed: %v", err)
+	}
+	command := func(m numbergenerator.Mutation, index uint64) *raft.Log {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		return &raft.Log{Type: raft.LogCommand, Index: index, Data: data}
+	}
+
+	// Every replica rejects a gap, so the command counts as applied.
+	gap := numbergenerator.Mutation{Type: numbergenerator.MutationAppend, Key: "orders", Number: 5}
+	result := f.Apply(command(gap, 1)).(applyResult)
+	if !errors.Is(result.err, numbergenerator.ErrInvalidMutation) {
+		t.Fatalf("Apply of a gap returned %v, want ErrInvalidMutation", result.err)
+	}
+	if f.applied != 1 {
+		t.Fatalf("applied = %d after a rejected command, want 1", f.applied)
+	}
+
+	// A generator that cannot write must not skip the command.
+	if err := os.RemoveAll(basePath); err != nil {
+		t.Fatalf("breaking the base path failed: %v", err)
+	}
+	if err := os.WriteFile(basePath, nil, 0644); err != nil {
+		t.Fatalf("breaking the base path failed: %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Apply did not panic on a storage error")
+			}
+		}()
+		f.Apply(command(numbergenerator.Mutation{Type: numbergenerator.MutationAppend, Key: "orders"}, 2))
+	}()
+	if f.applied != 1 {
+		t.Errorf("applied = %d after a failed command, want 1", f.applied)
+	}
+}
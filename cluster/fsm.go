@@ -0,0 +1,169 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/raft"
+
+	"queueguard/numbergenerator"
+)
+
+const appliedFileName = "applied" // Raft index of the last command applied to the generator
+
+// applyResult is returned by the FSM for every command.
+type applyResult struct {
+	number uint64 // Number assigned by an append
+	err    error
+}
+
+// fsm applies committed commands to the NumberGenerator. Unlike the in-memory
+// state machines raft usually drives, the generator keeps its state on disk, so
+// the index of the last applied command is stored next to it and commands raft
+// replays after a restart are skipped.
+type fsm struct {
+	ng          *numbergenerator.NumberGenerator
+	appliedPath string
+	applied     uint64
+}
+
+func newFSM(ng *numbergenerator.NumberGenerator, dataDir string) (*fsm, error) {
+	f := &fsm{ng: ng, appliedPath: filepath.Join(dataDir, appliedFileName)}
+
+	data, err := os.ReadFile(f.appliedPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case len(data) != 8:
+		return nil, errors.New("cluster: corrupt applied index file")
+	default:
+		f.applied = binary.BigEndian.Uint64(data)
+	}
+	return f, nil
+}
+
+// setApplied persists the index of the last applied command.
+func (f *fsm) setApplied(index uint64) error {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], index)
+
+	file, err := os.OpenFile(f.appliedPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(data[:], 0); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	f.applied = index
+	return nil
+}
+
+// Apply implements raft.FSM. A crash between applying a command and storing its
+// index replays the command once; numbergenerator.ApplyMutation recognises the
+// replayed append by its filename and the status update is idempotent.
+//
+// A command every replica rejects alike is answered with the error and counts as
+// applied. Any other failure, e.g. a full disk, leaves the node behind the log it
+// acknowledged, so Apply panics instead of letting raft move on without it.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	if l.Type != raft.LogCommand || l.Index <= f.applied {
+		return applyResult{}
+	}
+
+	var m numbergenerator.Mutation
+	if err := json.Unmarshal(l.Data, &m); err != nil {
+		return applyResult{err: err}
+	}
+
+	result := applyResult{err: f.ng.ApplyMutation(m)}
+	if result.err != nil && !errors.Is(result.err, numbergenerator.ErrInvalidMutation) {
+		panic(fmt.Sprintf("cluster: applying command %d: %v", l.Index, result.err))
+	}
+	if result.err == nil && m.Type == numbergenerator.MutationAppend {
+		result.number, result.err = f.lastNumber(m)
+	}
+	if err := f.setApplied(l.Index); err != nil && result.err == nil {
+		result.err = err
+	}
+	return result
+}
+
+func (f *fsm) lastNumber(m numbergenerator.Mutation) (uint64, error) {
+	if m.Group == "" {
+		return f.ng.GetLastNumber(m.Key)
+	}
+	group, err := f.ng.Group(m.Key, m.Group)
+	if err != nil {
+		return 0, err
+	}
+	return group.GetLastNumber()
+}
+
+// Snapshot implements raft.FSM. Raft does not apply commands while Snapshot runs,
+// so the generator is captured into a temporary file right away and Persist only
+// copies that file.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	file, err := os.CreateTemp(filepath.Dir(f.appliedPath), "snapshot-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], f.applied)
+	if _, err = file.Write(index[:]); err == nil {
+		err = f.ng.Snapshot(file)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &fsmSnapshot{file: file}, nil
+}
+
+// Restore implements raft.FSM by replacing the generator's state with a snapshot.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var index [8]byte
+	if _, err := io.ReadFull(rc, index[:]); err != nil {
+		return err
+	}
+	if err := f.ng.Restore(rc); err != nil {
+		return err
+	}
+	return f.setApplied(binary.BigEndian.Uint64(index[:]))
+}
+
+// fsmSnapshot is a captured generator state waiting to be persisted by raft.
+type fsmSnapshot struct {
+	file *os.File
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := io.Copy(sink, s.file); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
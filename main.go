@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"queueguard/numbergenerator"
 )
 
 func main() {
-	ng := numbergenerator.NewNumberGenerator("./data")
+	ng, err := numbergenerator.NewNumberGenerator("./data")
+	if err != nil {
+		fmt.Println("error: ", err)
+		os.Exit(1)
+	}
+	defer ng.Close()
 
 	// ng.AppendRecord("test1", 0)
 	// ng.AppendRecord("test", 0)
@@ -0,0 +1,326 @@
+// Package metrics collects counters, gauges and histograms and writes them in the
+// Prometheus text exposition format. It covers what QueueGuard exports without
+// depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds, from 50µs to 10s, suited
+// to file system latencies.
+var DefaultBuckets = []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Label is a name-value pair attached to a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// CollectFunc produces the samples of a gauge family at scrape time.
+type CollectFunc func(emit func(value float64, labels ...Label)) error
+
+// family is a metric name with its help text, type and series.
+type family struct {
+	name, help, typ string
+	series          []series
+}
+
+// series writes the lines of one labelled series of a family.
+type series interface {
+	write(w *bufio.Writer, name string) error
+}
+
+// Registry holds metric families and writes them on request.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// register adds a series to the family name, creating the family on first use.
+// Registering the same name with a different type panics, like registering an
+// invalid name does.
+func (r *Registry) register(name, help, typ string, s series) {
+	if !validName(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, exists := r.families[name]
+	if !exists {
+		f = &family{name: name, help: help, typ: typ}
+		r.families[name] = f
+	}
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s registered as %s and %s", name, f.typ, typ))
+	}
+	f.series = append(f.series, s)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	labels []Label
+	value  uint64
+}
+
+// NewCounter registers a counter series.
+func (r *Registry) NewCounter(name, help string, labels ...Label) *Counter {
+	c := &Counter{labels: labels}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// Inc adds one to the counter. It does nothing on a nil counter, so instrumented
+// code does not need to check whether metrics are enabled.
+func (c *Counter) Inc() {
+	if c != nil {
+		atomic.AddUint64(&c.value, 1)
+	}
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) error {
+	return writeSample(w, name, c.labels, float64(c.Value()))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	labels  []Label
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram series with the given upper bounds, or
+// DefaultBuckets when buckets is nil.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...Label) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &Histogram{labels: labels, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// Observe records a value. It does nothing on a nil histogram.
+func (h *Histogram) Observe(value float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.buckets, value) // First bucket with an upper bound >= value
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	if h != nil {
+		h.Observe(time.Since(start).Seconds())
+	}
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) error {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		labels := append(append([]Label(nil), h.labels...), Label{"le", formatFloat(bound)})
+		if err := writeSample(w, name+"_bucket", labels, float64(cumulative)); err != nil {
+			return err
+		}
+	}
+	labels := append(append([]Label(nil), h.labels...), Label{"le", "+Inf"})
+	if err := writeSample(w, name+"_bucket", labels, float64(count)); err != nil {
+		return err
+	}
+	if err := writeSample(w, name+"_sum", h.labels, sum); err != nil {
+		return err
+	}
+	return writeSample(w, name+"_count", h.labels, float64(count))
+}
+
+// gaugeFunc is a gauge family whose samples are produced at scrape time.
+type gaugeFunc struct {
+	collect CollectFunc
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64, labels ...Label) {
+	r.NewCollector(name, help, func(emit func(float64, ...Label)) error {
+		emit(fn(), labels...)
+		return nil
+	})
+}
+
+// NewCollector registers a gauge family whose series are produced by fn at
+// scrape time, e.g. one series per key.
+func (r *Registry) NewCollector(name, help string, fn CollectFunc) {
+	r.register(name, help, "gauge", &gaugeFunc{collect: fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer, name string) error {
+	var writeErr error
+	err := g.collect(func(value float64, labels ...Label) {
+		if writeErr == nil {
+			writeErr = writeSample(w, name, labels, value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// WritePrometheus writes all families in the Prometheus text format, sorted by name.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, &family{name: f.name, help: f.help, typ: f.typ, series: append([]series(nil), f.series...)})
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.series {
+			if err := s.write(bw, f.name); err != nil {
+				return fmt.Errorf("collecting %s: %w", f.name, err)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Serve exposes the registry on http://addr/metrics in the background. The
+// returned server is shut down by the caller.
+func Serve(addr string, r *Registry) (*http.Server, net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return server, listener.Addr(), nil
+}
+
+func writeSample(w *bufio.Writer, name string, labels []Label, value float64) error {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label.Name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabelValue(label.Value))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	_, err := w.WriteString("\n")
+	return err
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string        { return helpEscaper.Replace(help) }
+func escapeLabelValue(value string) string { return labelEscaper.Replace(value) }
+
+// validName reports whether name is a valid Prometheus metric name.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
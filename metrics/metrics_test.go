@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	reg := NewRegistry()
+	hits := reg.NewCounter("requests_total", "Requests by result.", Label{"result", "hit"})
+	reg.NewCounter("requests_total", "Requests by result.", Label{"result", "miss"})
+	latency := reg.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	reg.NewCollector("backlog", "Backlog per key.", func(emit func(float64, ...Label)) error {
+		emit(3, Label{"key", `a"b`})
+		return nil
+	})
+
+	hits.Inc()
+	hits.Inc()
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var out strings.Builder
+	if err := reg.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	want := `# HELP backlog Backlog per key.
+# TYPE backlog gauge
+backlog{key="a\"b"} 3
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP requests_total Requests by result.
+# TYPE requests_total counter
+requests_total{result="hit"} 2
+requests_total{result="miss"} 0
+`
+	if out.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	var nilCounter *Counter
+	nilCounter.Inc() // Disabled instruments ignore updates
+}
+
+func TestServe(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("up", "Always zero.")
+
+	server, addr, err := Serve("127.0.0.1:0", reg)
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "up 0\n") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,161 @@
+package numbergenerator
+
+import (
+	"context"
+	"time"
+)
+
+// AdvanceResult describes the outcome of TryAdvance for a record.
+type AdvanceResult string
+
+const (
+	Advanced    AdvanceResult = "advanced"     // The record was marked as done and the watermark moved to it
+	NotYetTurn  AdvanceResult = "not_yet_turn" // An earlier record or a dependency is still pending; retry later
+	AlreadyDone AdvanceResult = "already_done" // The record was done before, e.g. a redelivery; nothing to retry
+	Unknown     AdvanceResult = "unknown"      // The record does not exist, or the watermark skipped it without marking it
+)
+
+// TryAdvance marks number as done if it is its turn in primaryKey, like
+// UpdateStatusIfMatch, and reports why it was not when it was not. A consumer of an
+// at-least-once queue can acknowledge a redelivered message at once on AlreadyDone
+// instead of retrying it, while NotYetTurn asks for another try later.
+func (ng *NumberGenerator) TryAdvance(primaryKey string, number uint64) (AdvanceResult, error) {
+	return ng.tracedTryAdvance(context.Background(), stream{primaryKey: primaryKey}, "", number, false)
+}
+
+// TryAdvanceContext is TryAdvance traced as part of the trace in ctx. It waits for
+// the key's rate limit until ctx is done instead of failing.
+func (ng *NumberGenerator) TryAdvanceContext(ctx context.Context, primaryKey string, number uint64) (AdvanceResult, error) {
+	return ng.tracedTryAdvance(ctx, stream{primaryKey: primaryKey}, "", number, true)
+}
+
+// tracedTryAdvance is tryAdvance in a span of its own, for the TryAdvance methods.
+func (ng *NumberGenerator) tracedTryAdvance(ctx context.Context, s stream, consumer string, number uint64, wait bool) (result AdvanceResult, err error) {
+	ctx, span := ng.startSpan(ctx, "queueguard.TryAdvance", s, Attribute{"queueguard.number", number})
+	defer func() {
+		span.SetAttributes(Attribute{"queueguard.result", string(result)})
+		endSpan(span, err)
+	}()
+	if consumer != "" {
+		span.SetAttributes(Attribute{"queueguard.consumer", consumer})
+	}
+	return ng.tryAdvance(ctx, s, consumer, number, wait)
+}
+
+// tryAdvance marks number as done for the stream, or for its consumer group
+// consumer if set, if it is the record's turn.
+func (ng *NumberGenerator) tryAdvance(ctx context.Context, s stream, consumer string, number uint64, wait bool) (result AdvanceResult, err error) {
+	defer func() {
+		if result == Advanced {
+			ng.metrics.ifMatchHits.Inc()
+		} else if err == nil {
+			ng.metrics.ifMatchMisses.Inc()
+		}
+	}()
+	if err := validateKey(s.primaryKey); err != nil {
+		return Unknown, err
+	}
+
+	// Check the turn first without taking rate limit tokens; it is checked again
+	// under the lock below.
+	unlock := ng.lockStream(s)
+	result, turn, err := ng.checkTurnLocked(s, consumer, number)
+	unlock()
+	if err != nil || !turn {
+		return result, err
+	}
+
+	if ng.readOnly {
+		return Unknown, ErrReadOnly
+	}
+	defer ng.metrics.updateLatency.ObserveSince(time.Now())
+
+	charged := false
+	for {
+		met, generation, err := ng.dependenciesMet(s, consumer, number, number)
+		if err != nil {
+			return Unknown, err
+		}
+		if !met {
+			return NotYetTurn, nil
+		}
+		if !charged {
+			if err := ng.takeTokens(ctx, s.primaryKey, opAdvance, 1, wait); err != nil {
+				return Unknown, err
+			}
+			charged = true
+		}
+
+		// Compare and update under one lock, so two callers cannot both advance.
+		// The loser learns that the record is done now.
+		result, rewound, err := func() (_ AdvanceResult, _ bool, err error) {
+			defer ng.lockMutation(s)(&err)
+			if result, turn, err := ng.checkTurnLocked(s, consumer, number); err != nil || !turn {
+				return result, false, err
+			}
+			if ng.rewoundSince(generation) {
+				return Unknown, true, nil
+			}
+			advanced, err := ng.compareAndAdvanceLocked(s, consumer, number-1, number)
+			if err != nil {
+				return Unknown, false, err
+			}
+			if !advanced {
+				return NotYetTurn, false, nil
+			}
+			return Advanced, false, nil
+		}()
+		if !rewound {
+			if result != Advanced {
+				ng.refundTokens(s.primaryKey, opAdvance, 1)
+			}
+			return result, err
+		}
+	}
+}
+
+// checkTurnLocked reports whether it is number's turn in the stream, or in its
+// consumer group consumer if set, i.e. whether its watermark is number-1, and
+// otherwise the reason it is not. Dependencies are not checked. The caller must
+// hold the stream's lock.
+func (ng *NumberGenerator) checkTurnLocked(s stream, consumer string, number uint64) (AdvanceResult, bool, error) {
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return Unknown, false, err
+	}
+	if number == 0 || number > total {
+		return Unknown, false, nil
+	}
+
+	var status byte
+	var watermark uint64
+	if consumer != "" {
+		if status, err = ng.consumerStatusLocked(s, consumer, number); err != nil {
+			return Unknown, false, err
+		}
+		watermark, err = ng.consumerWatermarkLocked(s, consumer)
+	} else {
+		if status, err = ng.statusLocked(s, number); err != nil {
+			return Unknown, false, err
+		}
+		var header FileHeader
+		header, err = ng.readHeaderLocked(s)
+		watermark = header.LastUpdated
+	}
+	if err != nil {
+		return Unknown, false, err
+	}
+
+	// The status alone does not tell whether a record was processed: records may
+	// be appended with status 1. Only a record at or below the watermark is done.
+	switch {
+	case watermark == number-1:
+		return NotYetTurn, true, nil
+	case watermark < number:
+		return NotYetTurn, false, nil
+	case status == 1:
+		return AlreadyDone, false, nil
+	default:
+		return Unknown, false, nil // Passed by UpdateStatuses without being marked
+	}
+}
@@ -0,0 +1,104 @@
+package numbergenerator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrWindowFull is matched by the *WindowFullError returned when an append would
+// exceed the window of its stream.
+var ErrWindowFull = errors.New("append window is full")
+
+// WindowFullError reports an append rejected because too many records of its
+// stream are outstanding, i.e. appended but not yet below the watermark.
+type WindowFullError struct {
+	PrimaryKey   string
+	Group        string
+	TotalRecords uint64
+	Outstanding  uint64 // TotalRecords minus the watermark
+	Window       uint64
+}
+
+func (e *WindowFullError) Error() string {
+	stream := e.PrimaryKey
+	if e.Group != "" {
+		stream += "/" + e.Group
+	}
+	return fmt.Sprintf("%s: %d of %d records outstanding in %q", ErrWindowFull, e.Outstanding, e.Window, stream)
+}
+
+// Unwrap lets errors.Is match ErrWindowFull.
+func (e *WindowFullError) Unwrap() error {
+	return ErrWindowFull
+}
+
+// WithWindow caps the outstanding records of every stream at window. Once
+// TotalRecords minus the watermark reaches it, AppendRecord fails with a
+// *WindowFullError and AppendRecordContext waits until the consumer catches up or
+// its context is done. A window of 0, the default, leaves streams unbounded.
+// Replicated mutations passed to ApplyMutation are never held back.
+func WithWindow(window uint64) Option {
+	return func(ng *NumberGenerator) {
+		ng.defaultWindow = window
+	}
+}
+
+// SetKeyWindow overrides the window of primaryKey and its message groups at
+// runtime. A window of 0 removes the override, so the key falls back to the
+// window set with WithWindow.
+func (ng *NumberGenerator) SetKeyWindow(primaryKey string, window uint64) error {
+	if err := validateKey(primaryKey); err != nil {
+		return err
+	}
+
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if window == 0 {
+		delete(ng.windows, primaryKey)
+		return nil
+	}
+	if ng.windows == nil {
+		ng.windows = make(map[string]uint64)
+	}
+	ng.windows[primaryKey] = window
+	return nil
+}
+
+// KeyWindow returns the window in effect for primaryKey, 0 if it is unbounded.
+func (ng *NumberGenerator) KeyWindow(primaryKey string) uint64 {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if window, exists := ng.windows[primaryKey]; exists {
+		return window
+	}
+	return ng.defaultWindow
+}
+
+// checkWindowLocked returns a *WindowFullError if appending to the stream would
+// exceed its window. The caller must hold the stream's lock.
+func (ng *NumberGenerator) checkWindowLocked(s stream) error {
+	window := ng.KeyWindow(s.primaryKey)
+	if window == 0 {
+		return nil
+	}
+
+	header, err := ng.readHeaderLocked(s)
+	if err == io.EOF || os.IsNotExist(err) {
+		return nil // Nothing was appended yet
+	}
+	if err != nil {
+		return err
+	}
+	if header.TotalRecords <= header.LastUpdated || header.TotalRecords-header.LastUpdated < window {
+		return nil
+	}
+	return &WindowFullError{
+		PrimaryKey:   s.primaryKey,
+		Group:        s.group,
+		TotalRecords: header.TotalRecords,
+		Outstanding:  header.TotalRecords - header.LastUpdated,
+		Window:       window,
+	}
+}
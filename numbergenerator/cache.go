@@ -0,0 +1,66 @@
+package numbergenerator
+
+import "os"
+
+// cachedFile is an open stream file tracked by the LRU of NumberGenerator.
+type cachedFile struct {
+	path    string
+	lockKey string // Cache key of the stream owning the file, see stream.cacheKey
+	file    *os.File
+}
+
+// CacheStats reports how the file handle cache performed since the generator was created.
+type CacheStats struct {
+	Hits      uint64 // Lookups served by an already open handle
+	Misses    uint64 // Lookups that had to open the file
+	Evictions uint64 // Idle handles closed to stay below the open files limit
+	Open      int    // Handles currently open
+}
+
+// CacheStats returns the hit, miss and eviction counters of the file handle cache.
+func (ng *NumberGenerator) CacheStats() CacheStats {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+
+	stats := ng.cacheStats
+	stats.Open = len(ng.fileCache)
+	return stats
+}
+
+// evictLocked closes least recently used handles until there is room for one more.
+// Handles whose stream is locked are in use and are skipped, so the cache may
+// temporarily exceed its limit when every handle is busy. ng.lock must be held.
+func (ng *NumberGenerator) evictLocked() {
+	if ng.maxOpenFiles == 0 {
+		return
+	}
+
+	for elem := ng.lru.Back(); elem != nil && len(ng.fileCache) >= ng.maxOpenFiles; {
+		prev := elem.Prev()
+		cached := elem.Value.(*cachedFile)
+
+		// TryLock never blocks, so taking a stream lock while holding ng.lock
+		// cannot deadlock with callers that take them in the opposite order.
+		if lock := ng.locks[cached.lockKey]; lock != nil && lock.TryLock() {
+			cached.file.Close()
+			ng.lru.Remove(elem)
+			delete(ng.fileCache, cached.path)
+			ng.cacheStats.Evictions++
+			lock.Unlock()
+		}
+		elem = prev
+	}
+}
+
+// dropCachedFile closes and forgets the cached handle of filePath, if any, so the
+// next use reopens the file. The caller must hold the lock of the owning stream.
+func (ng *NumberGenerator) dropCachedFile(filePath string) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+
+	if elem, exists := ng.fileCache[filePath]; exists {
+		elem.Value.(*cachedFile).file.Close()
+		ng.lru.Remove(elem)
+		delete(ng.fileCache, filePath)
+	}
+}
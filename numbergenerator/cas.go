@@ -0,0 +1,131 @@
+package numbergenerator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CompareAndAdvance marks the records after expected up to and including next as
+// done and moves the watermark of primaryKey to next, but only if the watermark is
+// expected at that moment, and reports whether it did. The comparison and the
+// update happen under the key's lock, so of several concurrent calls with the same
+// expected value exactly one succeeds, and every watermark change of the key is
+// ordered with it.
+//
+// The call does not match while next does not exist yet or while a record in the
+// range waits for a dependency, see AppendRecordAfter. next must be above expected.
+func (ng *NumberGenerator) CompareAndAdvance(primaryKey string, expected, next uint64) (bool, error) {
+	return ng.compareAndAdvance(context.Background(), stream{primaryKey: primaryKey}, "", expected, next)
+}
+
+func (ng *NumberGenerator) compareAndAdvance(ctx context.Context, s stream, consumer string, expected, next uint64) (advanced bool, err error) {
+	_, span := ng.startSpan(ctx, "queueguard.CompareAndAdvance", s,
+		Attribute{"queueguard.expected", expected}, Attribute{"queueguard.next", next})
+	defer func() {
+		span.SetAttributes(Attribute{"queueguard.advanced", advanced})
+		endSpan(span, err)
+	}()
+	if consumer != "" {
+		span.SetAttributes(Attribute{"queueguard.consumer", consumer})
+	}
+
+	if err := validateKey(s.primaryKey); err != nil {
+		return false, err
+	}
+	if next <= expected {
+		return false, fmt.Errorf("cannot advance %q from %d to %d", s.cacheKey(), expected, next)
+	}
+	if ng.readOnly {
+		return false, ErrReadOnly
+	}
+
+	// Check the range against the stream before any work per record: calls that
+	// cannot match take no rate limit tokens, and next is known to exist. Both
+	// are checked again under the lock.
+	unlock := ng.lockStream(s)
+	total, watermark, err := ng.positionLocked(s, consumer)
+	unlock()
+	if err != nil || next > total || watermark != expected {
+		return false, err
+	}
+
+	charged := false
+	for {
+		met, generation, err := ng.dependenciesMet(s, consumer, expected+1, next)
+		if err != nil || !met {
+			return false, err
+		}
+		if !charged {
+			if err := ng.takeTokens(ctx, s.primaryKey, opAdvance, int(next-expected), false); err != nil {
+				return false, err
+			}
+			charged = true
+		}
+
+		advanced, rewound, err := func() (advanced, rewound bool, err error) {
+			defer ng.lockMutation(s)(&err)
+			if ng.rewoundSince(generation) {
+				return false, true, nil
+			}
+			advanced, err = ng.compareAndAdvanceLocked(s, consumer, expected, next)
+			return advanced, false, err
+		}()
+		if !rewound {
+			if !advanced {
+				ng.refundTokens(s.primaryKey, opAdvance, int(next-expected))
+			}
+			return advanced, err
+		}
+	}
+}
+
+// compareAndAdvanceLocked marks the records after expected up to next as done if
+// the watermark of the stream, or of its consumer group consumer if set, is
+// expected, and reports whether it did. The caller must hold the stream's lock,
+// which makes the comparison and the update a single step.
+func (ng *NumberGenerator) compareAndAdvanceLocked(s stream, consumer string, expected, next uint64) (bool, error) {
+	if next <= expected {
+		return false, nil
+	}
+	total, watermark, err := ng.positionLocked(s, consumer)
+	if err != nil || next > total || watermark != expected {
+		return false, err
+	}
+
+	m := Mutation{
+		Type:     MutationUpdateStatuses,
+		Key:      s.primaryKey,
+		Group:    s.group,
+		Consumer: consumer,
+		Numbers:  make([]uint64, 0, next-expected),
+		Time:     time.Now(),
+	}
+	for number := expected + 1; number <= next; number++ {
+		m.Numbers = append(m.Numbers, number)
+	}
+	if consumer != "" {
+		err = ng.updateConsumerLocked(s, consumer, m.Numbers, m.Time)
+	} else {
+		err = ng.updateStatusesLocked(s, m.Numbers, m.Time)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, ng.publish(m)
+}
+
+// positionLocked returns the number of records of a stream and its watermark, or
+// the watermark of its consumer group consumer if set. The caller must hold the
+// stream's lock.
+func (ng *NumberGenerator) positionLocked(s stream, consumer string) (total, watermark uint64, err error) {
+	if total, err = ng.totalRecordsLocked(s); err != nil || total == 0 {
+		return 0, 0, err
+	}
+	if consumer != "" {
+		watermark, err = ng.consumerWatermarkLocked(s, consumer)
+		return total, watermark, err
+	}
+	header, err := ng.readHeaderLocked(s)
+	return total, header.LastUpdated, err
+}
@@ -0,0 +1,356 @@
+package numbergenerator
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	consumersDir      = "consumers" // Directory inside a key holding its consumer groups
+	consumerFileExt   = ".bin"
+	consumerHeaderLen = 8 // The watermark, followed by one status byte per record
+)
+
+// Consumer is a named consumer group of a primary key. Every consumer group
+// tracks its own completion state of the key's records and its own watermark,
+// independent of the key's statuses and of other consumer groups, so several
+// services can work through the same ordered stream at their own pace.
+//
+// Consumer progress is included in snapshots and replicated through mutations,
+// but not written by Export.
+type Consumer struct {
+	ng     *NumberGenerator
+	stream stream
+	name   string
+}
+
+// Consumer returns the consumer group name of primaryKey. Names follow the rules
+// of group IDs. A consumer group exists once it marked its first record as done;
+// until then its watermark is 0.
+func (ng *NumberGenerator) Consumer(primaryKey, name string) (*Consumer, error) {
+	if err := validateKey(primaryKey); err != nil {
+		return nil, err
+	}
+	if err := validateName("consumer name", name); err != nil {
+		return nil, err
+	}
+	return &Consumer{ng: ng, stream: stream{primaryKey: primaryKey}, name: name}, nil
+}
+
+// Consumers lists the consumer groups that exist under primaryKey, sorted by name.
+func (ng *NumberGenerator) Consumers(primaryKey string) ([]string, error) {
+	if err := validateKey(primaryKey); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(ng.buildKeyPath(primaryKey), consumersDir))
+	if os.IsNotExist(err) {
+		return nil, nil // The key has no consumer groups yet
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, consumerFileExt) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(name, consumerFileExt))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PrimaryKey returns the primary key the consumer group belongs to.
+func (c *Consumer) PrimaryKey() string {
+	return c.stream.primaryKey
+}
+
+// Name returns the name of the consumer group.
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// GetLastUpdateNumber returns the watermark of the consumer group.
+func (c *Consumer) GetLastUpdateNumber() (uint64, error) {
+	defer c.ng.lockStream(c.stream)()
+	return c.ng.consumerWatermarkLocked(c.stream, c.name)
+}
+
+// GetStatus returns the status of a record for the consumer group: 1 if the group
+// marked it as done, 0 otherwise.
+func (c *Consumer) GetStatus(number uint64) (byte, error) {
+	defer c.ng.lockStream(c.stream)()
+
+	total, err := c.ng.totalRecordsLocked(c.stream)
+	if err != nil {
+		return 0, err
+	}
+	if number == 0 || number > total {
+		return 0, fmt.Errorf("record %d of %q does not exist", number, c.stream.cacheKey())
+	}
+	return c.ng.consumerStatusLocked(c.stream, c.name, number)
+}
+
+// UpdateStatuses marks records as done for the consumer group and sets its
+// watermark to the last number in the list, like NumberGenerator.UpdateStatuses
+// does for the key.
+func (c *Consumer) UpdateStatuses(numbers []uint64) (err error) {
+	if len(numbers) == 0 {
+		return nil
+	}
+	if c.ng.readOnly {
+		return ErrReadOnly
+	}
+	if err := c.ng.takeTokens(context.Background(), c.stream.primaryKey, opAdvance, len(numbers), false); err != nil {
+		return err
+	}
+
+	defer c.ng.lockMutation(c.stream)(&err)
+
+	m := Mutation{
+		Type:     MutationUpdateStatuses,
+		Key:      c.stream.primaryKey,
+		Consumer: c.name,
+		Numbers:  numbers,
+		Time:     time.Now(),
+	}
+	if err := c.ng.updateConsumerLocked(c.stream, c.name, m.Numbers, m.Time); err != nil {
+		c.ng.refundTokens(c.stream.primaryKey, opAdvance, len(numbers))
+		return err
+	}
+	return c.ng.publish(m)
+}
+
+// UpdateStatusIfMatch marks number as done for the consumer group if it is the
+// group's next record, i.e. if its watermark is number-1, and the record's
+// dependencies are met. A dependency on another key is met once the consumer
+// group of the same name in that key has reached its number; a dependency on a
+// message group is checked against the group itself.
+func (c *Consumer) UpdateStatusIfMatch(number uint64) (matched bool, err error) {
+	ctx, span := c.ng.startSpan(context.Background(), "queueguard.Consumer.UpdateStatusIfMatch", c.stream,
+		Attribute{"queueguard.consumer", c.name}, Attribute{"queueguard.number", number})
+	defer func() {
+		span.SetAttributes(Attribute{"queueguard.matched", matched})
+		endSpan(span, err)
+	}()
+	result, err := c.ng.tryAdvance(ctx, c.stream, c.name, number, false)
+	return result == Advanced, err
+}
+
+// TryAdvance marks number as done for the consumer group if it is the group's
+// next record, like UpdateStatusIfMatch, and reports why it was not when it was
+// not, see NumberGenerator.TryAdvance.
+func (c *Consumer) TryAdvance(number uint64) (AdvanceResult, error) {
+	return c.ng.tracedTryAdvance(context.Background(), c.stream, c.name, number, false)
+}
+
+// CompareAndAdvance moves the watermark of the consumer group from expected to
+// next, marking the records in between as done for the group, if it is expected
+// at that moment, see NumberGenerator.CompareAndAdvance.
+func (c *Consumer) CompareAndAdvance(expected, next uint64) (bool, error) {
+	return c.ng.compareAndAdvance(context.Background(), c.stream, c.name, expected, next)
+}
+
+// WaitForTurn blocks until it is number's turn for the consumer group, i.e. until
+// its watermark has reached number-1 and the record's dependencies are met, or
+// until ctx is done.
+func (c *Consumer) WaitForTurn(ctx context.Context, number uint64) error {
+	_, err := c.ng.awaitTurn(ctx, c.stream, c.name, number)
+	return err
+}
+
+// ProcessInOrder runs fn at number's turn for the consumer group and marks the
+// record as done for the group if it succeeds, see NumberGenerator.ProcessInOrder.
+// Failures are not reported by Gaps, which describes the key itself.
+func (c *Consumer) ProcessInOrder(ctx context.Context, number uint64, fn func() error, opts ...ProcessOption) error {
+	return c.ng.processInOrder(ctx, turnKey{stream: c.stream, consumer: c.name}, number, fn, opts)
+}
+
+// Rewind resets the records of the consumer group after number back to pending
+// and moves its watermark back to number. The key's own statuses and other
+// consumer groups are not affected. Like NumberGenerator.Rewind it must be
+// confirmed with ConfirmRewind.
+func (c *Consumer) Rewind(number uint64, opts ...RewindOption) (err error) {
+	var cfg rewindConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.confirmed {
+		return ErrRewindNotConfirmed
+	}
+	if c.ng.readOnly {
+		return ErrReadOnly
+	}
+
+	defer c.ng.lockMutation(c.stream)(&err)
+
+	m := Mutation{
+		Type:     MutationRewind,
+		Key:      c.stream.primaryKey,
+		Consumer: c.name,
+		Number:   number,
+		Time:     time.Now(),
+	}
+	if err := c.ng.rewindConsumerLocked(c.stream, c.name, m.Number, m.Time); err != nil {
+		return err
+	}
+	return c.ng.publish(m)
+}
+
+// consumer returns the consumer group a dependency is checked against for the
+// consumer group name, see Consumer.UpdateStatusIfMatch. For the stream itself,
+// name is empty and so is the result.
+func (d Dependency) consumer(name string) string {
+	if d.Group != "" {
+		return ""
+	}
+	return name
+}
+
+// buildConsumerPath returns the file of a consumer group, e.g. consumers/billing.bin.
+func (ng *NumberGenerator) buildConsumerPath(s stream, name string) string {
+	return filepath.Join(ng.buildKeyPath(s.primaryKey), consumersDir, name+consumerFileExt)
+}
+
+// openConsumerLocked returns the cached handle of a consumer group's file, or nil
+// if the group does not exist yet and create is false. The caller must hold the
+// stream's lock.
+func (ng *NumberGenerator) openConsumerLocked(s stream, name string, create bool) (*os.File, error) {
+	path := ng.buildConsumerPath(s, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if !create {
+			return nil, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return ng.ensureCachedFile(s, path)
+}
+
+// consumerWatermarkLocked returns the watermark of a consumer group. The caller
+// must hold the stream's lock.
+func (ng *NumberGenerator) consumerWatermarkLocked(s stream, name string) (uint64, error) {
+	file, err := ng.openConsumerLocked(s, name, false)
+	if err != nil || file == nil {
+		return 0, err
+	}
+	var watermark uint64
+	err = binary.Read(io.NewSectionReader(file, 0, consumerHeaderLen), binary.BigEndian, &watermark)
+	if err == io.EOF {
+		return 0, nil
+	}
+	return watermark, err
+}
+
+// consumerStatusLocked returns the status of a record for a consumer group. The
+// caller must hold the stream's lock.
+func (ng *NumberGenerator) consumerStatusLocked(s stream, name string, number uint64) (byte, error) {
+	file, err := ng.openConsumerLocked(s, name, false)
+	if err != nil || file == nil {
+		return 0, err
+	}
+	status := make([]byte, 1)
+	_, err = file.ReadAt(status, consumerHeaderLen+int64(number)-1)
+	if err == io.EOF {
+		return 0, nil // Never marked by the group
+	}
+	return status[0], err
+}
+
+// updateConsumerLocked marks records as done for a consumer group. The caller must
+// hold the stream's lock.
+func (ng *NumberGenerator) updateConsumerLocked(s stream, name string, numbers []uint64, at time.Time) error {
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if number == 0 || number > total {
+			return fmt.Errorf("record %d of %q does not exist", number, s.cacheKey())
+		}
+	}
+
+	file, err := ng.openConsumerLocked(s, name, true)
+	if err != nil {
+		return err
+	}
+	previous, err := ng.consumerWatermarkLocked(s, name)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if _, err := file.WriteAt([]byte{1}, consumerHeaderLen+int64(number)-1); err != nil {
+			return err
+		}
+	}
+	watermark := numbers[len(numbers)-1]
+	if err := writeAt(file, 0, watermark); err != nil {
+		return err
+	}
+	if err := ng.syncFile(file); err != nil {
+		return err
+	}
+
+	events := make([]Event, 0, len(numbers)+1)
+	for _, number := range numbers {
+		events = append(events, Event{Type: EventStatusChanged, Consumer: name, Number: number, Status: 1, Watermark: watermark, Time: at})
+	}
+	if watermark > previous {
+		events = append(events, Event{Type: EventWatermarkAdvanced, Consumer: name, Watermark: watermark, Time: at})
+	}
+	ng.notify(s, events...)
+	return nil
+}
+
+// rewindConsumerLocked resets the records of a consumer group after number and
+// moves its watermark back to number. The caller must hold the stream's lock.
+func (ng *NumberGenerator) rewindConsumerLocked(s stream, name string, number uint64, at time.Time) error {
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return err
+	}
+	if number > total {
+		return fmt.Errorf("cannot rewind %q to %d, it has %d records", s.cacheKey(), number, total)
+	}
+	file, err := ng.openConsumerLocked(s, name, false)
+	if err != nil || file == nil {
+		return err // Nothing was marked by the group yet
+	}
+
+	ng.rewinds.Add(1) // Before any watermark moves back, see dependenciesMet
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if marked := info.Size() - consumerHeaderLen; marked > int64(number) {
+		if _, err := file.WriteAt(make([]byte, marked-int64(number)), consumerHeaderLen+int64(number)); err != nil {
+			return err
+		}
+	}
+	watermark, err := ng.consumerWatermarkLocked(s, name)
+	if err != nil {
+		return err
+	}
+	if watermark > number {
+		watermark = number
+		if err := writeAt(file, 0, watermark); err != nil {
+			return err
+		}
+	}
+	if err := ng.syncFile(file); err != nil {
+		return err
+	}
+
+	ng.notify(s, Event{Type: EventRewound, Consumer: name, Number: number + 1, Watermark: watermark, Time: at})
+	return nil
+}
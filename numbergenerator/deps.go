@@ -0,0 +1,266 @@
+package numbergenerator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const depsFileExt = ".deps"
+
+// Dependency declares that a record must not be processed before another stream
+// has reached a number, i.e. before the watermark of Key, or of its message group
+// Group when set, is at least Number.
+type Dependency struct {
+	Key    string `json:"key"`
+	Group  string `json:"group,omitempty"`
+	Number uint64 `json:"number"`
+}
+
+// stream returns the stream the dependency refers to.
+func (d Dependency) stream() stream {
+	return stream{primaryKey: d.Key, group: d.Group}
+}
+
+// depsEntry is a line of the dependencies file kept next to a stream. The file is
+// only appended to; a later line for the same number replaces an earlier one, and
+// a line without dependencies removes them.
+type depsEntry struct {
+	Number    uint64       `json:"number"`
+	DependsOn []Dependency `json:"depends_on,omitempty"`
+}
+
+// buildDepsPath returns the dependencies file of a stream, e.g. data.deps next to data.bin.
+func (ng *NumberGenerator) buildDepsPath(s stream) string {
+	return strings.TrimSuffix(ng.buildStreamPath(s), groupFileExt) + depsFileExt
+}
+
+// AppendRecordAfter appends a record to primaryKey like AppendRecordContext, and
+// declares that it depends on every stream in deps reaching the given number. The
+// ordering gate, UpdateStatusIfMatch and WaitForTurn, then holds the record until
+// both its predecessor in primaryKey and all of its dependencies are done.
+//
+// Dependencies are not checked for cycles: two records depending on each other
+// are never released.
+func (ng *NumberGenerator) AppendRecordAfter(ctx context.Context, primaryKey string, status byte, deps ...Dependency) (uint64, error) {
+	return ng.appendRecord(ctx, stream{primaryKey: primaryKey}, status, deps, true)
+}
+
+// Dependencies returns the dependencies declared for a record of primaryKey, nil
+// if it has none.
+func (ng *NumberGenerator) Dependencies(primaryKey string, number uint64) ([]Dependency, error) {
+	return ng.dependencies(stream{primaryKey: primaryKey}, number)
+}
+
+func (ng *NumberGenerator) dependencies(s stream, number uint64) ([]Dependency, error) {
+	if err := validateKey(s.primaryKey); err != nil {
+		return nil, err
+	}
+	defer ng.lockStream(s)()
+
+	deps, err := ng.loadDependenciesLocked(s)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Dependency(nil), deps[number]...), nil
+}
+
+// validateDependencies checks the dependencies of a record appended to s.
+func validateDependencies(s stream, deps []Dependency) error {
+	for _, dep := range deps {
+		if err := validateKey(dep.Key); err != nil {
+			return err
+		}
+		if dep.Group != "" {
+			if err := validateGroupID(dep.Group); err != nil {
+				return err
+			}
+		}
+		if dep.Number == 0 {
+			return fmt.Errorf("dependency on %q must name a number", dep.stream().cacheKey())
+		}
+		if dep.stream() == s {
+			return fmt.Errorf("a record of %q cannot depend on its own stream", s.cacheKey())
+		}
+	}
+	return nil
+}
+
+// loadDependenciesLocked returns the dependencies of a stream keyed by record
+// number, reading the dependencies file the first time. The map may only be used
+// while the stream is locked. Lines for records past the
+// end of the stream were left by an append that did not complete; they are
+// removed so that the number's next record does not inherit them. The caller must
+// hold the stream's lock.
+func (ng *NumberGenerator) loadDependenciesLocked(s stream) (map[uint64][]Dependency, error) {
+	ng.lock.Lock()
+	deps, ok := ng.deps[s]
+	ng.lock.Unlock()
+	if ok {
+		return deps, nil
+	}
+
+	deps = make(map[uint64][]Dependency)
+	file, err := os.Open(ng.buildDepsPath(s))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry depsEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// Only the last line can be torn by a crash, a partial line is dropped.
+				continue
+			}
+			if len(entry.DependsOn) == 0 {
+				delete(deps, entry.Number)
+			} else {
+				deps[entry.Number] = entry.DependsOn
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		total, err := ng.totalRecordsLocked(s)
+		if err != nil {
+			return nil, err
+		}
+		for number := range deps {
+			if number <= total {
+				continue
+			}
+			delete(deps, number)
+			if !ng.readOnly {
+				if err := ng.writeDependenciesLocked(s, depsEntry{Number: number}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	ng.lock.Lock()
+	ng.deps[s] = deps
+	ng.lock.Unlock()
+	return deps, nil
+}
+
+// setDependenciesLocked records the dependencies of the record about to be
+// appended as number. The caller must hold the stream's lock.
+func (ng *NumberGenerator) setDependenciesLocked(s stream, number uint64, deps []Dependency) error {
+	current, err := ng.loadDependenciesLocked(s)
+	if err != nil {
+		return err
+	}
+	if len(deps) == 0 && current[number] == nil {
+		return nil
+	}
+	if err := ng.writeDependenciesLocked(s, depsEntry{Number: number, DependsOn: deps}); err != nil {
+		return err
+	}
+	if len(deps) == 0 {
+		delete(current, number)
+	} else {
+		current[number] = deps
+	}
+	return nil
+}
+
+// writeDependenciesLocked appends a line to the dependencies file. The caller must
+// hold the stream's lock.
+func (ng *NumberGenerator) writeDependenciesLocked(s stream, entry depsEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := ng.ensureCachedFile(s, ng.buildDepsPath(s))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// dropDependencies forgets the loaded dependencies of the given streams, or of all
+// streams when none are given, after their files were replaced.
+func (ng *NumberGenerator) dropDependencies(streams ...stream) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if len(streams) == 0 {
+		ng.deps = make(map[stream]map[uint64][]Dependency)
+	}
+	for _, s := range streams {
+		delete(ng.deps, s)
+	}
+}
+
+// dependenciesMet reports whether the dependencies of the records first to last of
+// a stream are met, for the consumer group consumer or for the stream itself if
+// consumer is empty.
+//
+// Dependencies refer to other streams, whose locks must not be taken while the
+// stream is locked, so they are checked before the caller locks it. A Rewind or a
+// Restore of a dependency may lower its watermark in between. The returned
+// generation lets the caller detect that under the stream's lock with rewoundSince
+// and check again; if nothing was rewound, the dependencies are still met, as
+// watermarks only move forward otherwise.
+func (ng *NumberGenerator) dependenciesMet(s stream, consumer string, first, last uint64) (met bool, generation uint64, err error) {
+	generation = ng.rewinds.Load()
+
+	unlock := ng.lockStream(s)
+	loaded, err := ng.loadDependenciesLocked(s)
+	var deps []Dependency
+	for number, d := range loaded {
+		if number >= first && number <= last {
+			deps = append(deps, d...)
+		}
+	}
+	unlock()
+	if err != nil {
+		return false, generation, err
+	}
+
+	for _, dep := range deps {
+		watermark, err := ng.watermark(dep.stream(), dep.consumer(consumer))
+		if err != nil {
+			return false, generation, err
+		}
+		if watermark < dep.Number {
+			return false, generation, nil
+		}
+	}
+	return true, generation, nil
+}
+
+// rewoundSince reports whether a watermark may have moved back since generation
+// was returned by dependenciesMet.
+func (ng *NumberGenerator) rewoundSince(generation uint64) bool {
+	return ng.rewinds.Load() != generation
+}
+
+// watermark returns the watermark of a stream, or of its consumer group consumer
+// if set. A stream that does not exist yet has a watermark of 0.
+func (ng *NumberGenerator) watermark(s stream, consumer string) (uint64, error) {
+	if consumer != "" {
+		defer ng.lockStream(s)()
+		return ng.consumerWatermarkLocked(s, consumer)
+	}
+	if _, err := os.Stat(ng.buildStreamPath(s)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	watermark, err := ng.getLastUpdateNumber(s)
+	if err == io.EOF {
+		return 0, nil // Nothing appended yet
+	}
+	return watermark, err
+}
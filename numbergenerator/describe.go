@@ -0,0 +1,45 @@
+package numbergenerator
+
+import (
+	"io"
+	"os"
+)
+
+// KeyDescription summarises the state and the limits of a primary key.
+type KeyDescription struct {
+	PrimaryKey   string
+	TotalRecords uint64 // Of the key's default stream
+	Watermark    uint64
+	Groups       []string
+	Consumers    []string
+
+	Window       uint64           // Outstanding records allowed per stream, 0 if unbounded
+	AppendLimit  *RateLimitStatus // Nil if appends are not rate limited
+	AdvanceLimit *RateLimitStatus // Nil if status updates are not rate limited
+}
+
+// Describe reports the counters of primaryKey together with the window and rate
+// limits currently applied to it.
+func (ng *NumberGenerator) Describe(primaryKey string) (KeyDescription, error) {
+	desc := KeyDescription{PrimaryKey: primaryKey}
+	if err := validateKey(primaryKey); err != nil {
+		return desc, err
+	}
+
+	header, err := ng.readHeader(stream{primaryKey: primaryKey})
+	if err != nil && err != io.EOF && !os.IsNotExist(err) {
+		return desc, err
+	}
+	desc.TotalRecords, desc.Watermark = header.TotalRecords, header.LastUpdated
+
+	if desc.Groups, err = ng.Groups(primaryKey); err != nil {
+		return desc, err
+	}
+	if desc.Consumers, err = ng.Consumers(primaryKey); err != nil {
+		return desc, err
+	}
+	desc.Window = ng.KeyWindow(primaryKey)
+	desc.AppendLimit = ng.rateLimitStatus(primaryKey, opAppend)
+	desc.AdvanceLimit = ng.rateLimitStatus(primaryKey, opAdvance)
+	return desc, nil
+}
@@ -0,0 +1,72 @@
+package numbergenerator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockFileName = "LOCK"
+
+var (
+	// ErrLocked is returned when another process holds the lock on the base path.
+	ErrLocked = errors.New("base path is locked by another process")
+
+	// ErrReadOnly is returned by mutating calls on a generator opened WithReadOnly.
+	ErrReadOnly = errors.New("number generator is read-only")
+)
+
+// acquireDirLock takes an advisory lock on basePath/LOCK for the lifetime of the
+// generator. Writers take an exclusive lock, so two processes can never write the
+// same base path. Read-only generators take a shared lock, which any number of
+// inspection tools can hold at once while no writer is running. Only writers
+// create the lock file; a read-only generator finding none has no writer to
+// exclude and takes no lock.
+func (ng *NumberGenerator) acquireDirLock() error {
+	path := filepath.Join(ng.basePath, lockFileName)
+
+	flag := os.O_RDONLY | os.O_CREATE
+	if ng.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if ng.readOnly && os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := lockFile(file, ng.readOnly); err != nil {
+		file.Close()
+		if errors.Is(err, errWouldBlock) {
+			return fmt.Errorf("%w: %s", ErrLocked, ng.basePath)
+		}
+		return fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	ng.dirLock = file
+	return nil
+}
+
+// Close stops the stall detector, ends all subscriptions created by Watch, closes
+// all open files and releases the lock on the base path. The generator must not be
+// used afterwards.
+func (ng *NumberGenerator) Close() error {
+	if ng.stallDetector != nil {
+		ng.stallDetector.stop()
+		ng.stallDetector = nil
+	}
+	ng.closeWatchers()
+	err := errors.Join(ng.CloseAllFiles(), ng.closeGlobalLog())
+
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if ng.dirLock == nil {
+		return err
+	}
+	lockErr := ng.dirLock.Close() // Closing the descriptor releases the lock
+	ng.dirLock = nil
+	return errors.Join(err, lockErr)
+}
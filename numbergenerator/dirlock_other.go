@@ -0,0 +1,16 @@
+//go:build !unix
+
+package numbergenerator
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock would block")
+
+// lockFile is a no-op on platforms without flock; processes sharing a base path
+// are not detected there.
+func lockFile(file *os.File, shared bool) error {
+	return nil
+}
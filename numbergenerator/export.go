@@ -0,0 +1,504 @@
+package numbergenerator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	importFileExt   = ".import"   // Suffix of the files Import writes before swapping them in
+	replacedFileExt = ".replaced" // Suffix of the files an import replaces, until it is complete
+)
+
+// exportHeader is the first line of every exported stream.
+type exportHeader struct {
+	Type         string `json:"type"` // Always "header"
+	Key          string `json:"key"`
+	Group        string `json:"group,omitempty"`
+	TotalRecords uint64 `json:"total_records"`
+	LastUpdated  uint64 `json:"last_updated"`
+}
+
+// exportRecord is the line of a single record, following the header of its stream.
+type exportRecord struct {
+	Type       string       `json:"type"` // Always "record"
+	Key        string       `json:"key"`
+	Group      string       `json:"group,omitempty"`
+	Number     uint64       `json:"number"`
+	Status     byte         `json:"status"`
+	Filename   string       `json:"filename"`
+	AppendedAt *time.Time   `json:"appended_at,omitempty"`
+	UpdatedAt  *time.Time   `json:"updated_at,omitempty"`
+	DependsOn  []Dependency `json:"depends_on,omitempty"`
+}
+
+// ImportedRecord is a record of a stream replaced by Import, see MutationImport.
+type ImportedRecord struct {
+	Number     uint64       `json:"number"`
+	Status     byte         `json:"status"`
+	Filename   string       `json:"filename"`
+	AppendedAt *time.Time   `json:"appended_at,omitempty"`
+	UpdatedAt  *time.Time   `json:"updated_at,omitempty"`
+	DependsOn  []Dependency `json:"depends_on,omitempty"`
+}
+
+// importLine holds any line written by Export.
+type importLine struct {
+	Type         string `json:"type"`
+	Key          string `json:"key"`
+	Group        string `json:"group"`
+	TotalRecords uint64 `json:"total_records"`
+	LastUpdated  uint64 `json:"last_updated"`
+	ImportedRecord
+}
+
+// Export writes the state of the given keys, or of all keys when none are given,
+// to w as JSON Lines. Every stream is written as a header line followed by one
+// line per record, message groups as streams of their own:
+//
+//	{"type":"header","key":"orders","total_records":2,"last_updated":1}
+//	{"type":"record","key":"orders","number":1,"status":1,"filename":"...","appended_at":"...","updated_at":"..."}
+//	{"type":"record","key":"orders","number":2,"status":0,"filename":"...","appended_at":"..."}
+//
+// Timestamps are omitted for records written before they were tracked, and the
+// dependencies of records appended with AppendRecordAfter are listed in depends_on.
+func (ng *NumberGenerator) Export(w io.Writer, primaryKeys ...string) error {
+	if len(primaryKeys) == 0 {
+		err := ng.walkKeys(func(primaryKey, dir string) error {
+			primaryKeys = append(primaryKeys, primaryKey)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, primaryKey := range primaryKeys {
+		if err := validateKey(primaryKey); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(ng.buildFilePath(primaryKey)); err == nil {
+			if err := ng.exportStream(enc, stream{primaryKey: primaryKey}); err != nil {
+				return err
+			}
+		}
+
+		groups, err := ng.Groups(primaryKey)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := ng.exportStream(enc, stream{primaryKey: primaryKey, group: group}); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func (ng *NumberGenerator) exportStream(enc *json.Encoder, s stream) error {
+	defer ng.lockStream(s)()
+
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := FileHeader{}
+	err = binary.Read(file, binary.BigEndian, &header)
+	if err == io.EOF {
+		return nil // Nothing was appended yet
+	}
+	if err != nil {
+		return err
+	}
+
+	err = enc.Encode(exportHeader{
+		Type:         "header",
+		Key:          s.primaryKey,
+		Group:        s.group,
+		TotalRecords: header.TotalRecords,
+		LastUpdated:  header.LastUpdated,
+	})
+	if err != nil {
+		return err
+	}
+
+	deps, err := ng.loadDependenciesLocked(s)
+	if err != nil {
+		return err
+	}
+
+	// Read the records through their own reader, the times are read with seeks on
+	// a different file.
+	records := bufio.NewReader(io.NewSectionReader(file, headerSize, int64(header.TotalRecords)*recordSize))
+	for number := uint64(1); number <= header.TotalRecords; number++ {
+		var record NumberStatusFilename
+		if err := binary.Read(records, binary.BigEndian, &record); err != nil {
+			return err
+		}
+		times, err := ng.getTimes(s, number)
+		if err != nil {
+			return err
+		}
+
+		err = enc.Encode(exportRecord{
+			Type:       "record",
+			Key:        s.primaryKey,
+			Group:      s.group,
+			Number:     record.Number,
+			Status:     record.Status,
+			Filename:   strings.TrimRight(string(record.Filename[:]), "\x00"),
+			AppendedAt: unixTime(times.AppendedAt),
+			UpdatedAt:  unixTime(times.UpdatedAt),
+			DependsOn:  deps[number],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importStream collects the records of one stream in temporary files until the
+// stream is complete and can replace the current files.
+type importStream struct {
+	stream   stream
+	header   FileHeader
+	next     uint64 // Number of the next expected record
+	data     *os.File
+	times    *os.File
+	deps     *os.File // Created for the first record with dependencies
+	depsPath string
+	records  []ImportedRecord // Kept for the mutation when hooks are registered
+	collect  bool
+}
+
+// Import rebuilds the streams contained in JSON Lines written by Export. Every
+// stream in the input replaces the stream of the same key and group, other
+// streams are left alone. A stream is only replaced once all of its records were
+// read, and records must be numbered consecutively from 1.
+//
+// A replaced stream is passed to the mutation hooks as a MutationImport, and its
+// subscribers receive an EventImported. The consumer groups of a replaced key
+// start over: they are rewound to 0. With WithGlobalSequence, the records of a
+// replaced stream are stamped after every sequence number issued so far.
+func (ng *NumberGenerator) Import(r io.Reader) error {
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+
+	var current *importStream
+	defer func() {
+		if current != nil {
+			current.abort()
+		}
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var line importLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		switch line.Type {
+		case "header":
+			if current != nil {
+				if err := ng.finishImport(current, time.Now()); err != nil {
+					return err
+				}
+				current = nil
+			}
+			stream, err := ng.beginImport(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			current = stream
+		case "record":
+			if current == nil || line.Key != current.stream.primaryKey || line.Group != current.stream.group {
+				return fmt.Errorf("line %d: record does not follow the header of its stream", lineNumber)
+			}
+			if err := current.add(line.ImportedRecord); err != nil {
+				return fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+		default:
+			return fmt.Errorf("line %d: unknown line type %q", lineNumber, line.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if current != nil {
+		err := ng.finishImport(current, time.Now())
+		current = nil
+		return err
+	}
+	return nil
+}
+
+// applyImport replaces a stream with the records of a MutationImport.
+func (ng *NumberGenerator) applyImport(m Mutation) error {
+	is, err := ng.beginImport(importLine{
+		Type:         "header",
+		Key:          m.Key,
+		Group:        m.Group,
+		TotalRecords: uint64(len(m.Records)),
+		LastUpdated:  m.Watermark,
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range m.Records {
+		if err := is.add(record); err != nil {
+			is.abort()
+			return err
+		}
+	}
+	return ng.finishImport(is, m.Time)
+}
+
+// beginImport validates a header line and creates the temporary files of its stream.
+func (ng *NumberGenerator) beginImport(line importLine) (*importStream, error) {
+	s := stream{primaryKey: line.Key, group: line.Group}
+	if err := validateKey(s.primaryKey); err != nil {
+		return nil, err
+	}
+	if s.group != "" {
+		if err := validateGroupID(s.group); err != nil {
+			return nil, err
+		}
+	}
+	if line.LastUpdated > line.TotalRecords {
+		return nil, fmt.Errorf("last_updated %d exceeds total_records %d", line.LastUpdated, line.TotalRecords)
+	}
+
+	if err := ng.ensureKeyDir(s.primaryKey); err != nil {
+		return nil, err
+	}
+	dataPath := ng.buildStreamPath(s)
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		return nil, err
+	}
+
+	ng.lock.Lock()
+	collect := len(ng.hooks) > 0
+	ng.lock.Unlock()
+
+	is := &importStream{
+		stream:   s,
+		header:   FileHeader{TotalRecords: line.TotalRecords, LastUpdated: line.LastUpdated},
+		next:     1,
+		depsPath: ng.buildDepsPath(s),
+		collect:  collect,
+	}
+	var err error
+	if is.data, err = os.Create(dataPath + importFileExt); err != nil {
+		return nil, err
+	}
+	if is.times, err = os.Create(ng.buildTimesPath(s) + importFileExt); err != nil {
+		is.abort()
+		return nil, err
+	}
+	if err := binary.Write(is.data, binary.BigEndian, &is.header); err != nil {
+		is.abort()
+		return nil, err
+	}
+	return is, nil
+}
+
+// add appends a record to the temporary files.
+func (is *importStream) add(line ImportedRecord) error {
+	if err := validateImportedRecord(is.stream, is.next, is.header.TotalRecords, line); err != nil {
+		return err
+	}
+
+	record := NumberStatusFilename{Number: line.Number, Status: line.Status}
+	copy(record.Filename[:], line.Filename)
+	if err := binary.Write(is.data, binary.BigEndian, &record); err != nil {
+		return err
+	}
+
+	var times recordTimes
+	if line.AppendedAt != nil {
+		times.AppendedAt = line.AppendedAt.UnixNano()
+	}
+	if line.UpdatedAt != nil {
+		times.UpdatedAt = line.UpdatedAt.UnixNano()
+	}
+	if err := binary.Write(is.times, binary.BigEndian, &times); err != nil {
+		return err
+	}
+
+	if len(line.DependsOn) > 0 {
+		if is.deps == nil {
+			var err error
+			if is.deps, err = os.Create(is.depsPath + importFileExt); err != nil {
+				return err
+			}
+		}
+		entry, err := json.Marshal(depsEntry{Number: line.Number, DependsOn: line.DependsOn})
+		if err != nil {
+			return err
+		}
+		if _, err := is.deps.Write(append(entry, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if is.collect {
+		is.records = append(is.records, line)
+	}
+	is.next++
+	return nil
+}
+
+// validateImportedRecord checks that line is record next of an import of total
+// records into s.
+func validateImportedRecord(s stream, next, total uint64, line ImportedRecord) error {
+	if line.Number != next {
+		return fmt.Errorf("expected record %d, got %d", next, line.Number)
+	}
+	if line.Number > total {
+		return fmt.Errorf("record %d exceeds total_records %d", line.Number, total)
+	}
+	if len(line.Filename) > len(NumberStatusFilename{}.Filename) {
+		return fmt.Errorf("filename %q is too long", line.Filename)
+	}
+	return validateDependencies(s, line.DependsOn)
+}
+
+// abort closes and removes the temporary files.
+func (is *importStream) abort() {
+	for _, file := range []*os.File{is.data, is.times, is.deps} {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+}
+
+// finishImport checks that a stream is complete, swaps its files in and rewinds
+// the consumer groups of the key. The current files are moved aside first, and
+// back if any file cannot be swapped in.
+func (ng *NumberGenerator) finishImport(is *importStream, at time.Time) (err error) {
+	if is.next-1 != is.header.TotalRecords {
+		is.abort()
+		return fmt.Errorf("stream %q has %d of %d records", is.stream.cacheKey(), is.next-1, is.header.TotalRecords)
+	}
+	for _, file := range []*os.File{is.data, is.times, is.deps} {
+		if file == nil {
+			continue
+		}
+		if err := ng.syncFile(file); err != nil {
+			is.abort()
+			return err
+		}
+		file.Close()
+	}
+
+	defer ng.lockMutation(is.stream)(&err)
+	if err := ng.checkFence(is.stream); err != nil {
+		is.abort()
+		return err
+	}
+
+	seqPath := ng.buildSeqPath(is.stream)
+	firstSeq, err := ng.stampImportLocked(is.stream, is.header.TotalRecords, seqPath+importFileExt)
+	if err != nil {
+		is.abort()
+		return err
+	}
+	// Files without a staged replacement are removed: the deps of a stream
+	// without dependencies, and the seq of one imported without stamps.
+	paths := []string{ng.buildStreamPath(is.stream), ng.buildTimesPath(is.stream), is.depsPath, seqPath}
+	staged := []bool{true, true, is.deps != nil, firstSeq != 0}
+
+	ng.rewinds.Add(1) // Before any watermark moves back, see dependenciesMet
+	for _, path := range paths {
+		ng.dropCachedFile(path)
+	}
+	ng.dropDependencies(is.stream)
+	sw := &swap{logger: ng.logger}
+	for i, path := range paths {
+		if _, err = os.Stat(path); err == nil {
+			os.Remove(path + replacedFileExt) // Left behind by an import that crashed
+			err = sw.move(path, path+replacedFileExt)
+		} else if os.IsNotExist(err) {
+			err = nil // The stream has no such file yet
+		}
+		if err == nil && staged[i] {
+			err = sw.move(path+importFileExt, path)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		sw.undo()
+		is.abort()
+		os.Remove(seqPath + importFileExt)
+		if firstSeq != 0 {
+			err = errors.Join(err, ng.voidGlobalRangeLocked(is.stream, firstSeq, firstSeq+is.header.TotalRecords-1))
+		}
+		return err
+	}
+	for _, path := range paths {
+		os.Remove(path + replacedFileExt)
+	}
+	ng.metrics.backlog.set(is.stream, is.header)
+
+	// The entries of the replaced records are void now, and the new ones settle
+	// by the imported watermark like those of appended records.
+	if firstSeq != 0 {
+		if err := ng.voidGlobalRangeLocked(is.stream, 1, firstSeq-1); err != nil {
+			return err
+		}
+		if err := ng.markGlobalDoneLocked(is.stream, numberRange(1, is.header.LastUpdated)); err != nil {
+			return err
+		}
+	}
+
+	// Consumer groups are tracked on the default stream only.
+	if is.stream.group == "" {
+		consumers, err := ng.Consumers(is.stream.primaryKey)
+		if err != nil {
+			return err
+		}
+		for _, name := range consumers {
+			if err := ng.rewindConsumerLocked(is.stream, name, 0, at); err != nil {
+				return err
+			}
+		}
+	}
+
+	ng.notify(is.stream, Event{Type: EventImported, Number: is.header.TotalRecords, Watermark: is.header.LastUpdated, Time: at})
+	return ng.publish(Mutation{
+		Type:      MutationImport,
+		Key:       is.stream.primaryKey,
+		Group:     is.stream.group,
+		Time:      at,
+		Watermark: is.header.LastUpdated,
+		Records:   is.records,
+	})
+}
@@ -0,0 +1,100 @@
+package numbergenerator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// Gap is a record above the watermark that is not done yet.
+type Gap struct {
+	Number     uint64
+	Status     byte
+	AppendedAt time.Time     // Zero for records appended before times were tracked
+	Waiting    time.Duration // Time since AppendedAt, 0 if it is unknown
+
+	// Attempts counts the failed runs of ProcessInOrder for the record and
+	// LastError holds the error of the last one. Both are kept in memory only.
+	Attempts  int
+	LastError string
+}
+
+// GapReport describes why the watermark of a stream is not at its last record.
+type GapReport struct {
+	PrimaryKey   string
+	Group        string // Empty for the key's default stream
+	TotalRecords uint64
+	Watermark    uint64
+
+	// Blocking is the number the watermark waits for, i.e. Watermark+1, or 0 when
+	// the watermark is at the last record.
+	Blocking uint64
+
+	// Pending lists every record between the watermark and TotalRecords whose
+	// status is not done, in order.
+	Pending []Gap
+}
+
+// Gaps reports the records of primaryKey that are still not done above its
+// watermark, how long each of them has waited and which number blocks the watermark.
+func (ng *NumberGenerator) Gaps(primaryKey string) (GapReport, error) {
+	return ng.gaps(stream{primaryKey: primaryKey})
+}
+
+func (ng *NumberGenerator) gaps(s stream) (GapReport, error) {
+	report := GapReport{PrimaryKey: s.primaryKey, Group: s.group}
+	if err := validateKey(s.primaryKey); err != nil {
+		return report, err
+	}
+
+	defer ng.lockStream(s)()
+
+	header, err := ng.readHeaderLocked(s)
+	if err == io.EOF || os.IsNotExist(err) {
+		return report, nil // Nothing was appended yet
+	}
+	if err != nil {
+		return report, err
+	}
+	report.TotalRecords, report.Watermark = header.TotalRecords, header.LastUpdated
+	if header.LastUpdated >= header.TotalRecords {
+		return report, nil
+	}
+	report.Blocking = header.LastUpdated + 1
+
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	first := header.LastUpdated + 1
+	records := bufio.NewReader(io.NewSectionReader(file,
+		headerSize+int64(first-1)*recordSize, int64(header.TotalRecords-header.LastUpdated)*recordSize))
+	for number := first; number <= header.TotalRecords; number++ {
+		var record NumberStatusFilename
+		if err := binary.Read(records, binary.BigEndian, &record); err != nil {
+			return report, err
+		}
+		if record.Status == 1 {
+			continue
+		}
+
+		gap := Gap{Number: number, Status: record.Status}
+		times, err := ng.getTimes(s, number)
+		if err != nil {
+			return report, err
+		}
+		if times.AppendedAt != 0 {
+			gap.AppendedAt = time.Unix(0, times.AppendedAt)
+			gap.Waiting = now.Sub(gap.AppendedAt)
+		}
+		if failure, ok := ng.lastFailure(s, number); ok {
+			gap.Attempts, gap.LastError = failure.attempts, failure.err
+		}
+		report.Pending = append(report.Pending, gap)
+	}
+	return report, nil
+}
@@ -0,0 +1,691 @@
+package numbergenerator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	globalDirName         = "global"  // Directory in basePath holding the global log
+	globalLogFileName     = "log.bin" // FileHeader followed by one globalEntry per sequence number
+	globalStreamsFileName = "streams" // JSON Lines naming the streams referenced by the log
+	seqFileExt            = ".seq"    // Global sequence numbers of a stream's records, indexed by number
+)
+
+// States of a globalEntry.
+const (
+	globalPending byte = iota // The record is not done yet
+	globalDone                // The record is done
+	globalVoid                // The append crashed before the record was written; skipped by replays
+)
+
+// ErrNoGlobalSequence is returned by the global sequence methods of a generator
+// that was not opened WithGlobalSequence.
+var ErrNoGlobalSequence = errors.New("global sequence is not enabled")
+
+// globalEntry is the entry of a sequence number in the global log.
+type globalEntry struct {
+	Stream uint32 // Index of the stream in the streams file
+	Number uint64
+	State  byte
+}
+
+var globalEntrySize = int64(binary.Size(globalEntry{}))
+
+// globalStreamLine is a line of the streams file. Streams are numbered in the
+// order of their lines.
+type globalStreamLine struct {
+	Key   string `json:"key"`
+	Group string `json:"group,omitempty"`
+}
+
+// globalLog assigns sequence numbers across all streams. Its header counts the
+// sequence numbers issued in TotalRecords and holds the global watermark in
+// LastUpdated, the highest sequence number up to which every record is done.
+//
+// Locks are taken in the order stream lock, then mu.
+type globalLog struct {
+	mu      sync.Mutex
+	log     *os.File // nil on a read-only generator without a global log
+	streams *os.File
+	header  FileHeader
+	names   []stream
+	ids     map[stream]uint32
+}
+
+// GlobalRecord is a record in the global order, see ReplayGlobal.
+type GlobalRecord struct {
+	Sequence   uint64
+	PrimaryKey string
+	Group      string // Empty for the key's default stream
+	Number     uint64
+	Filename   string
+	Done       bool // The watermark of the record's stream has reached it
+}
+
+// WithGlobalSequence stamps every appended record, in every key and group, with a
+// sequence number that increases across all of them. The sequence defines a total
+// order of all records that ReplayGlobal walks, and GlobalWatermark tracks up to
+// which sequence number all records are done.
+//
+// Records appended while the option was not set have no sequence number. Import
+// stamps the records of every stream it replaces in a fresh range, in record
+// order, and the records up to the imported watermark count as done.
+func WithGlobalSequence() Option {
+	return func(ng *NumberGenerator) {
+		ng.global = &globalLog{}
+	}
+}
+
+// buildSeqPath returns the sequence file of a stream, e.g. data.seq next to data.bin.
+func (ng *NumberGenerator) buildSeqPath(s stream) string {
+	return strings.TrimSuffix(ng.buildStreamPath(s), groupFileExt) + seqFileExt
+}
+
+// openGlobalLog opens the global log and settles the entries above the watermark
+// that a crash may have left behind. The caller must hold the barrier for writing
+// or not have shared the generator yet.
+func (ng *NumberGenerator) openGlobalLog() error {
+	g := ng.global
+	dir := filepath.Join(ng.basePath, globalDirName)
+	flag := os.O_RDWR | os.O_CREATE
+	if ng.readOnly {
+		flag = os.O_RDONLY
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var err error
+	g.header = FileHeader{}
+	g.names = nil
+	g.ids = make(map[stream]uint32)
+	if g.log, err = os.OpenFile(filepath.Join(dir, globalLogFileName), flag, 0666); err != nil {
+		if ng.readOnly && os.IsNotExist(err) {
+			return nil // Nothing was stamped yet
+		}
+		return err
+	}
+	if g.streams, err = os.OpenFile(filepath.Join(dir, globalStreamsFileName), flag, 0666); err != nil {
+		return err
+	}
+
+	err = binary.Read(io.NewSectionReader(g.log, 0, headerSize), binary.BigEndian, &g.header)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	scanner := bufio.NewScanner(g.streams)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line globalStreamLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			break // A torn last line, the stream it named was never referenced
+		}
+		s := stream{primaryKey: line.Key, group: line.Group}
+		g.ids[s] = uint32(len(g.names))
+		g.names = append(g.names, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if ng.readOnly {
+		return nil
+	}
+	return ng.reconcileGlobalLog()
+}
+
+// reconcileGlobalLog compares the entries above the watermark with the records
+// they refer to. Entries of appends that never completed are voided, and records
+// the watermark reached without it being logged are marked done. The caller
+// must hold the barrier for writing or not have shared the generator yet.
+func (ng *NumberGenerator) reconcileGlobalLog() error {
+	g := ng.global
+	for seq := g.header.LastUpdated + 1; seq <= g.header.TotalRecords; seq++ {
+		entry, err := g.entry(seq)
+		if err != nil {
+			return err
+		}
+		if entry.State != globalPending {
+			continue
+		}
+		if int(entry.Stream) >= len(g.names) {
+			return fmt.Errorf("global sequence %d refers to unknown stream %d", seq, entry.Stream)
+		}
+		s := g.names[entry.Stream]
+
+		state := globalVoid
+		total, err := ng.totalRecordsLocked(s)
+		if err != nil {
+			return err
+		}
+		if entry.Number <= total {
+			stamped, err := ng.readSeqLocked(s, entry.Number)
+			if err != nil {
+				return err
+			}
+			if stamped == seq {
+				header, err := ng.readHeaderLocked(s)
+				if err != nil {
+					return err
+				}
+				state = globalPending
+				if entry.Number <= header.LastUpdated {
+					state = globalDone
+				}
+			}
+		}
+		if state != globalPending {
+			if err := g.setState(seq, state); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.advance(); err != nil {
+		return err
+	}
+	return g.log.Sync()
+}
+
+// closeGlobalLog closes the files of the global log.
+func (ng *NumberGenerator) closeGlobalLog() error {
+	g := ng.global
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var errs []error
+	for _, file := range []*os.File{g.log, g.streams} {
+		if file != nil {
+			errs = append(errs, file.Close())
+		}
+	}
+	g.log, g.streams = nil, nil
+	return errors.Join(errs...)
+}
+
+// stampLocked assigns the next global sequence number to the record about to be
+// appended to s as number. The entry is logged before the record is written, so
+// a record never exists without it. It returns the sequence number, 0 without
+// WithGlobalSequence. If the append fails, the caller voids the entry with
+// voidStamp; after a crash reconcileGlobalLog does. The caller must hold the
+// stream's lock.
+func (ng *NumberGenerator) stampLocked(s stream, number uint64) (uint64, error) {
+	g := ng.global
+	if g == nil {
+		return 0, nil
+	}
+
+	seq, err := g.add(s, number, 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := ng.writeSeqLocked(s, number, seq); err != nil {
+		// Without its sequence number the entry can never be matched to the record.
+		return 0, errors.Join(err, ng.voidStamp(seq))
+	}
+	return seq, nil
+}
+
+// voidStamp voids the global entry of an append that failed before the record was
+// counted, so that the global watermark does not wait for it.
+func (ng *NumberGenerator) voidStamp(seq uint64) error {
+	g := ng.global
+	if g == nil || seq == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.setState(seq, globalVoid), g.advance())
+}
+
+// markGlobalDoneLocked marks the global entries of records the stream's watermark
+// reached as done and advances the global watermark. The caller must hold the
+// stream's lock.
+func (ng *NumberGenerator) markGlobalDoneLocked(s stream, numbers []uint64) error {
+	g := ng.global
+	if g == nil {
+		return nil
+	}
+
+	seqs := make([]uint64, len(numbers))
+	for i, number := range numbers {
+		seq, err := ng.readSeqLocked(s, number)
+		if err != nil {
+			return err
+		}
+		seqs[i] = seq
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id, known := g.ids[s]
+	for i, seq := range seqs {
+		if !known || seq == 0 || seq > g.header.TotalRecords {
+			continue // Appended without a sequence number, or stamped before a restore that did not keep it
+		}
+		entry, err := g.entry(seq)
+		if err != nil {
+			return err
+		}
+		if entry.Stream != id || entry.Number != numbers[i] || entry.State != globalPending {
+			continue
+		}
+		if err := g.setState(seq, globalDone); err != nil {
+			return err
+		}
+	}
+	if err := g.advance(); err != nil {
+		return err
+	}
+	return ng.syncFile(g.log)
+}
+
+// rewindGlobalLocked marks the global entries of records reset by Rewind, or left
+// above the watermark by UpdateStatuses, as pending again and moves the global
+// watermark back before the first of them. The caller must hold the stream's lock.
+func (ng *NumberGenerator) rewindGlobalLocked(s stream, numbers []uint64) error {
+	g := ng.global
+	if g == nil || len(numbers) == 0 {
+		return nil
+	}
+
+	seqs := make([]uint64, len(numbers))
+	for i, number := range numbers {
+		seq, err := ng.readSeqLocked(s, number)
+		if err != nil {
+			return err
+		}
+		seqs[i] = seq
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id, known := g.ids[s]
+	header := g.header
+	for i, seq := range seqs {
+		if !known || seq == 0 || seq > header.TotalRecords {
+			continue
+		}
+		entry, err := g.entry(seq)
+		if err != nil {
+			return err
+		}
+		if entry.Stream != id || entry.Number != numbers[i] || entry.State != globalDone {
+			continue
+		}
+		if err := g.setState(seq, globalPending); err != nil {
+			return err
+		}
+		if seq <= header.LastUpdated {
+			header.LastUpdated = seq - 1
+		}
+	}
+	if header != g.header {
+		if err := writeAt(g.log, 0, &header); err != nil {
+			return err
+		}
+		g.header = header
+	}
+	return ng.syncFile(g.log)
+}
+
+// numberRange returns the numbers from first to last, none if last < first.
+func numberRange(first, last uint64) []uint64 {
+	if last < first {
+		return nil
+	}
+	numbers := make([]uint64, 0, last-first+1)
+	for number := first; number <= last; number++ {
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
+
+// stampImportLocked logs pending entries for the total records an import is about
+// to swap into s and writes their sequence numbers to path, the sequence file that
+// is swapped in with the records. It returns the first sequence number, 0 without
+// WithGlobalSequence. Until the file is in place the entries match no record, so
+// after a crash reconcileGlobalLog voids them; if the swap fails, the caller voids
+// them with voidGlobalRangeLocked. The caller must hold the stream's lock.
+func (ng *NumberGenerator) stampImportLocked(s stream, total uint64, path string) (uint64, error) {
+	g := ng.global
+	if g == nil || total == 0 {
+		return 0, nil
+	}
+
+	first, err := g.add(s, 1, total)
+	if err != nil {
+		return 0, err
+	}
+	if err := ng.writeSeqFile(path, first, total); err != nil {
+		os.Remove(path)
+		return 0, errors.Join(err, ng.voidGlobalRangeLocked(s, first, first+total-1))
+	}
+	return first, nil
+}
+
+// writeSeqFile writes a sequence file for count records stamped from first on.
+func (ng *NumberGenerator) writeSeqFile(path string, first, count uint64) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	for seq := first; seq < first+count; seq++ {
+		if err := binary.Write(w, binary.BigEndian, seq); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := ng.syncFile(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// voidGlobalRangeLocked voids the pending entries of s from first to last, e.g.
+// those of records replaced by Import. The caller must hold the stream's lock.
+func (ng *NumberGenerator) voidGlobalRangeLocked(s stream, first, last uint64) error {
+	g := ng.global
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id, known := g.ids[s]
+	if !known {
+		return nil
+	}
+	first = max(first, g.header.LastUpdated+1)
+	last = min(last, g.header.TotalRecords)
+	for seq := first; seq <= last; seq++ {
+		entry, err := g.entry(seq)
+		if err != nil {
+			return err
+		}
+		if entry.Stream == id && entry.State == globalPending {
+			if err := g.setState(seq, globalVoid); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.advance(); err != nil {
+		return err
+	}
+	return ng.syncFile(g.log)
+}
+
+// add logs pending entries for count records of s from number on and returns the
+// sequence number of the first.
+func (g *globalLog) add(s stream, number, count uint64) (uint64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id, known := g.ids[s]
+	if !known {
+		line, err := json.Marshal(globalStreamLine{Key: s.primaryKey, Group: s.group})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := g.streams.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+		if _, err := g.streams.Write(append(line, '\n')); err != nil {
+			return 0, err
+		}
+		id = uint32(len(g.names))
+		g.ids[s] = id
+		g.names = append(g.names, s)
+	}
+
+	seq := g.header.TotalRecords + 1
+	entries := make([]globalEntry, count)
+	for i := range entries {
+		entries[i] = globalEntry{Stream: id, Number: number + uint64(i), State: globalPending}
+	}
+	if err := writeAt(g.log, headerSize+int64(seq-1)*globalEntrySize, entries); err != nil {
+		return 0, err
+	}
+	header := g.header
+	header.TotalRecords = seq + count - 1
+	if err := writeAt(g.log, 0, &header); err != nil {
+		return 0, err
+	}
+	g.header = header
+	return seq, nil
+}
+
+// entry reads the entry of a sequence number. The caller must hold mu.
+func (g *globalLog) entry(seq uint64) (globalEntry, error) {
+	var entry globalEntry
+	r := io.NewSectionReader(g.log, headerSize+int64(seq-1)*globalEntrySize, globalEntrySize)
+	err := binary.Read(r, binary.BigEndian, &entry)
+	return entry, err
+}
+
+// setState overwrites the state of an entry. The caller must hold mu.
+func (g *globalLog) setState(seq uint64, state byte) error {
+	_, err := g.log.WriteAt([]byte{state}, headerSize+int64(seq)*globalEntrySize-1)
+	return err
+}
+
+// advance moves the watermark past all entries that are done or void. The caller
+// must hold mu.
+func (g *globalLog) advance() error {
+	header := g.header
+	for header.LastUpdated < header.TotalRecords {
+		entry, err := g.entry(header.LastUpdated + 1)
+		if err != nil {
+			return err
+		}
+		if entry.State == globalPending {
+			break
+		}
+		header.LastUpdated++
+	}
+	if header == g.header {
+		return nil
+	}
+	if err := writeAt(g.log, 0, &header); err != nil {
+		return err
+	}
+	g.header = header
+	return nil
+}
+
+// writeAt writes the big-endian encoding of data at offset.
+func writeAt(file *os.File, offset int64, data interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, data); err != nil {
+		return err
+	}
+	_, err := file.WriteAt(buf.Bytes(), offset)
+	return err
+}
+
+// writeSeqLocked records the sequence number of a record. The caller must hold
+// the stream's lock.
+func (ng *NumberGenerator) writeSeqLocked(s stream, number, seq uint64) error {
+	file, err := ng.ensureCachedFile(s, ng.buildSeqPath(s))
+	if err != nil {
+		return err
+	}
+	return writeAt(file, (int64(number)-1)*8, seq)
+}
+
+// readSeqLocked returns the sequence number of a record, 0 if it has none. The
+// caller must hold the stream's lock.
+func (ng *NumberGenerator) readSeqLocked(s stream, number uint64) (uint64, error) {
+	file, err := ng.openCachedFile(s, ng.buildSeqPath(s), false)
+	if os.IsNotExist(err) {
+		return 0, nil // Reading does not create missing files
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var seq uint64
+	err = binary.Read(io.NewSectionReader(file, (int64(number)-1)*8, 8), binary.BigEndian, &seq)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// statusLocked returns the status of a record. The caller must hold the stream's lock.
+func (ng *NumberGenerator) statusLocked(s stream, number uint64) (byte, error) {
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return 0, err
+	}
+	status := make([]byte, 1)
+	if _, err := file.ReadAt(status, headerSize+(int64(number)-1)*recordSize+8); err != nil {
+		return 0, err
+	}
+	return status[0], nil
+}
+
+// GlobalSequence returns the global sequence number of a record of primaryKey, 0
+// if it was appended without one.
+func (ng *NumberGenerator) GlobalSequence(primaryKey string, number uint64) (uint64, error) {
+	return ng.globalSequence(stream{primaryKey: primaryKey}, number)
+}
+
+func (ng *NumberGenerator) globalSequence(s stream, number uint64) (uint64, error) {
+	if ng.global == nil {
+		return 0, ErrNoGlobalSequence
+	}
+	if err := validateKey(s.primaryKey); err != nil {
+		return 0, err
+	}
+	defer ng.lockStream(s)()
+	return ng.readSeqLocked(s, number)
+}
+
+// LastGlobalSequence returns the last global sequence number issued.
+func (ng *NumberGenerator) LastGlobalSequence() (uint64, error) {
+	header, err := ng.globalHeader()
+	return header.TotalRecords, err
+}
+
+// GlobalWatermark returns the highest global sequence number up to which every
+// record is done. Consumers that replay the global order can safely resume from
+// the sequence number after it.
+func (ng *NumberGenerator) GlobalWatermark() (uint64, error) {
+	header, err := ng.globalHeader()
+	return header.LastUpdated, err
+}
+
+func (ng *NumberGenerator) globalHeader() (FileHeader, error) {
+	if ng.global == nil {
+		return FileHeader{}, ErrNoGlobalSequence
+	}
+	ng.barrier.RLock()
+	defer ng.barrier.RUnlock()
+	ng.global.mu.Lock()
+	defer ng.global.mu.Unlock()
+	return ng.global.header, nil
+}
+
+// ReplayGlobal calls fn for every record with a global sequence number of at least
+// from, in global order, up to the last sequence number issued when it was
+// called. Entries of appends that never completed are skipped. Replaying stops at
+// the first error returned by fn.
+func (ng *NumberGenerator) ReplayGlobal(from uint64, fn func(GlobalRecord) error) error {
+	if ng.global == nil {
+		return ErrNoGlobalSequence
+	}
+	if from == 0 {
+		from = 1
+	}
+	last, err := ng.LastGlobalSequence()
+	if err != nil {
+		return err
+	}
+
+	for seq := from; seq <= last; seq++ {
+		record, ok, err := ng.globalRecord(seq)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globalRecord looks up the record of a sequence number. It returns ok false for
+// void entries.
+func (ng *NumberGenerator) globalRecord(seq uint64) (GlobalRecord, bool, error) {
+	ng.barrier.RLock()
+	g := ng.global
+	g.mu.Lock()
+	if seq > g.header.TotalRecords {
+		// Replaced by a Restore since the replay started.
+		g.mu.Unlock()
+		ng.barrier.RUnlock()
+		return GlobalRecord{}, false, nil
+	}
+	entry, err := g.entry(seq)
+	var s stream
+	if err == nil && int(entry.Stream) < len(g.names) {
+		s = g.names[entry.Stream]
+	} else if err == nil {
+		err = fmt.Errorf("global sequence %d refers to unknown stream %d", seq, entry.Stream)
+	}
+	g.mu.Unlock()
+	ng.barrier.RUnlock()
+	if err != nil || entry.State == globalVoid {
+		return GlobalRecord{}, false, err
+	}
+
+	record := GlobalRecord{
+		Sequence:   seq,
+		PrimaryKey: s.primaryKey,
+		Group:      s.group,
+		Number:     entry.Number,
+	}
+	// The entry is logged before its record is written, so wait for the append
+	// by taking the stream's lock before reading the record.
+	defer ng.lockStream(s)()
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return GlobalRecord{}, false, err
+	}
+	if entry.Number > total {
+		return GlobalRecord{}, false, nil // The append failed and was voided
+	}
+	if stamped, err := ng.readSeqLocked(s, entry.Number); err != nil || stamped != seq {
+		return GlobalRecord{}, false, err // Replaced by an Import, or by a later append after a failed one
+	}
+	if record.Filename, err = ng.filenameLocked(s, entry.Number); err != nil {
+		return GlobalRecord{}, false, err
+	}
+	// Records may be appended with status 1, so the watermark tells whether the
+	// record was processed.
+	header, err := ng.readHeaderLocked(s)
+	if err != nil {
+		return GlobalRecord{}, false, err
+	}
+	record.Done = entry.Number <= header.LastUpdated
+	return record, true, nil
+}
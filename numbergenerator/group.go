@@ -0,0 +1,209 @@
+package numbergenerator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	groupsDir    = "groups" // Directory inside a key holding its message groups
+	groupFileExt = ".bin"
+
+	maxGroupIDLength = 128
+)
+
+// Group is an independent ordered sub-sequence inside a primary key, similar to an
+// SQS message group. Every group has its own counter and watermark, while all groups
+// share the storage directory of their primary key.
+type Group struct {
+	ng     *NumberGenerator
+	stream stream
+}
+
+// Group returns the message group groupID of primaryKey. Group IDs may contain
+// letters, digits, '-', '_' and '.', and are at most 128 characters long.
+func (ng *NumberGenerator) Group(primaryKey, groupID string) (*Group, error) {
+	if err := validateKey(primaryKey); err != nil {
+		return nil, err
+	}
+	if err := validateGroupID(groupID); err != nil {
+		return nil, err
+	}
+	return &Group{ng: ng, stream: stream{primaryKey: primaryKey, group: groupID}}, nil
+}
+
+// Groups lists the message groups that exist under primaryKey, sorted by ID.
+func (ng *NumberGenerator) Groups(primaryKey string) ([]string, error) {
+	if err := validateKey(primaryKey); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(ng.buildGroupsPath(primaryKey))
+	if os.IsNotExist(err) {
+		return nil, nil // The key has no groups yet
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, groupFileExt) {
+			continue
+		}
+		groups = append(groups, strings.TrimSuffix(name, groupFileExt))
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func validateGroupID(groupID string) error {
+	return validateName("group ID", groupID)
+}
+
+// validateName checks a name that is used as a file name inside a key directory,
+// such as a group ID. kind names it in errors.
+func validateName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s must not be empty", kind)
+	}
+	if len(name) > maxGroupIDLength {
+		return fmt.Errorf("%s %q exceeds %d characters", kind, name, maxGroupIDLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid %s %q", kind, name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("%s %q contains invalid character %q", kind, name, c)
+		}
+	}
+	return nil
+}
+
+// PrimaryKey returns the primary key the group belongs to.
+func (g *Group) PrimaryKey() string {
+	return g.stream.primaryKey
+}
+
+// ID returns the group ID.
+func (g *Group) ID() string {
+	return g.stream.group
+}
+
+// AppendRecord appends a record to the group and returns its number within the
+// group. Groups are held to the window of their primary key, counted per group.
+func (g *Group) AppendRecord(status byte) (uint64, error) {
+	return g.ng.appendRecord(context.Background(), g.stream, status, nil, false)
+}
+
+// AppendRecordContext is AppendRecord traced as part of the trace in ctx. If the
+// group's window is full, it waits for the consumer to catch up until ctx is done.
+func (g *Group) AppendRecordContext(ctx context.Context, status byte) (uint64, error) {
+	return g.ng.appendRecord(ctx, g.stream, status, nil, true)
+}
+
+// AppendRecordAfter is AppendRecordContext for a record that depends on every
+// stream in deps reaching the given number, see NumberGenerator.AppendRecordAfter.
+func (g *Group) AppendRecordAfter(ctx context.Context, status byte, deps ...Dependency) (uint64, error) {
+	return g.ng.appendRecord(ctx, g.stream, status, deps, true)
+}
+
+// Dependencies returns the dependencies declared for a record of the group.
+func (g *Group) Dependencies(number uint64) ([]Dependency, error) {
+	return g.ng.dependencies(g.stream, number)
+}
+
+// GlobalSequence returns the global sequence number of a record of the group, see
+// NumberGenerator.GlobalSequence.
+func (g *Group) GlobalSequence(number uint64) (uint64, error) {
+	return g.ng.globalSequence(g.stream, number)
+}
+
+// Rewind resets the records of the group after number back to pending, see
+// NumberGenerator.Rewind.
+func (g *Group) Rewind(number uint64, opts ...RewindOption) error {
+	return g.ng.rewind(g.stream, number, opts)
+}
+
+// GetLastNumber returns the last number issued in the group.
+func (g *Group) GetLastNumber() (uint64, error) {
+	return g.ng.getLastNumber(g.stream)
+}
+
+// GetLastUpdateNumber returns the watermark of the group.
+func (g *Group) GetLastUpdateNumber() (uint64, error) {
+	return g.ng.getLastUpdateNumber(g.stream)
+}
+
+// GetStatus retrieves the status for a given number in the group.
+func (g *Group) GetStatus(number uint64) (byte, error) {
+	return g.ng.getStatus(g.stream, number)
+}
+
+// GetFilename retrieves the filename for a given number in the group.
+func (g *Group) GetFilename(number uint64) (string, error) {
+	return g.ng.getFilename(g.stream, number)
+}
+
+// UpdateStatuses sets the status of the given numbers to 1 and moves the group's
+// watermark to the last of them.
+func (g *Group) UpdateStatuses(numbers []uint64) error {
+	return g.ng.updateStatuses(context.Background(), g.stream, numbers, false)
+}
+
+// UpdateStatusesContext is UpdateStatuses waiting for the key's rate limit until
+// ctx is done instead of failing.
+func (g *Group) UpdateStatusesContext(ctx context.Context, numbers []uint64) error {
+	return g.ng.updateStatuses(ctx, g.stream, numbers, true)
+}
+
+// UpdateStatusIfMatch marks number as done if it directly follows the group's watermark.
+func (g *Group) UpdateStatusIfMatch(number uint64) (bool, error) {
+	return g.ng.updateStatusIfMatch(context.Background(), g.stream, number, false)
+}
+
+// UpdateStatusIfMatchContext is UpdateStatusIfMatch traced as part of the trace in
+// ctx. It waits for the key's rate limit until ctx is done instead of failing.
+func (g *Group) UpdateStatusIfMatchContext(ctx context.Context, number uint64) (bool, error) {
+	return g.ng.updateStatusIfMatch(ctx, g.stream, number, true)
+}
+
+// WaitForTurn blocks until the group's watermark has reached number-1 or ctx is done.
+func (g *Group) WaitForTurn(ctx context.Context, number uint64) error {
+	return g.ng.waitForTurn(ctx, g.stream, number)
+}
+
+// TryAdvance marks number as done if it is its turn in the group and reports why
+// it was not when it was not, see NumberGenerator.TryAdvance.
+func (g *Group) TryAdvance(number uint64) (AdvanceResult, error) {
+	return g.ng.tracedTryAdvance(context.Background(), g.stream, "", number, false)
+}
+
+// CompareAndAdvance moves the watermark of the group from expected to next, see
+// NumberGenerator.CompareAndAdvance.
+func (g *Group) CompareAndAdvance(expected, next uint64) (bool, error) {
+	return g.ng.compareAndAdvance(context.Background(), g.stream, "", expected, next)
+}
+
+// ProcessInOrder runs fn at number's turn in the group and marks the record as
+// done if it succeeds, see NumberGenerator.ProcessInOrder.
+func (g *Group) ProcessInOrder(ctx context.Context, number uint64, fn func() error, opts ...ProcessOption) error {
+	return g.ng.processInOrder(ctx, turnKey{stream: g.stream}, number, fn, opts)
+}
+
+// Gaps reports the records of the group that are still not done above its watermark.
+func (g *Group) Gaps() (GapReport, error) {
+	return g.ng.gaps(g.stream)
+}
+
+// Watch returns a channel of the changes made to the group, see NumberGenerator.Watch.
+func (g *Group) Watch(ctx context.Context, opts ...WatchOption) (<-chan Event, error) {
+	return g.ng.watch(ctx, g.stream, opts)
+}
@@ -0,0 +1,166 @@
+package numbergenerator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	keyFileName = "key" // Stores the original primary key inside its encoded directory
+
+	maxKeyLength = 1024
+)
+
+// ErrInvalidKey is returned for primary keys that cannot be stored.
+var ErrInvalidKey = errors.New("invalid primary key")
+
+// validateKey checks that a primary key can be encoded into a directory. Keys are
+// arbitrary UTF-8 strings of up to 1024 bytes without NUL characters.
+func validateKey(primaryKey string) error {
+	if primaryKey == "" {
+		return fmt.Errorf("%w: key must not be empty", ErrInvalidKey)
+	}
+	if len(primaryKey) > maxKeyLength {
+		return fmt.Errorf("%w: key exceeds %d bytes", ErrInvalidKey, maxKeyLength)
+	}
+	if !utf8.ValidString(primaryKey) {
+		return fmt.Errorf("%w: key %q is not valid UTF-8", ErrInvalidKey, primaryKey)
+	}
+	if strings.ContainsRune(primaryKey, 0) {
+		return fmt.Errorf("%w: key %q contains a NUL character", ErrInvalidKey, primaryKey)
+	}
+	return nil
+}
+
+// encodeKey maps a primary key to the name of its directory. The name is the hex
+// encoded first half of the key's SHA-256 sum, so it never contains separators or
+// dot segments no matter what the key looks like. The mapping is reversed through
+// the key file stored in the directory.
+func encodeKey(primaryKey string) string {
+	sum := sha256.Sum256([]byte(primaryKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// buildKeyPath returns the directory holding all files of a primary key. With a
+// fan-out of n the directory is nested below n levels of two-character prefixes of
+// its name, e.g. basePath/3f/a2/3fa2.../ for a fan-out of 2.
+func (ng *NumberGenerator) buildKeyPath(primaryKey string) string {
+	name := encodeKey(primaryKey)
+	parts := []string{ng.basePath}
+	for i := 0; i < ng.fanOut; i++ {
+		parts = append(parts, name[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+// ensureKeyDir creates the directory of a key together with its key file.
+func (ng *NumberGenerator) ensureKeyDir(primaryKey string) error {
+	keyDir := ng.buildKeyPath(primaryKey)
+	keyFile := filepath.Join(keyDir, keyFileName)
+	if _, err := os.Stat(keyFile); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(keyDir, 0755); err != nil {
+		return err
+	}
+	return writeKeyFile(keyDir, primaryKey)
+}
+
+// writeKeyFile records the original primary key in its directory.
+func writeKeyFile(keyDir, primaryKey string) error {
+	return writeFileAtomic(filepath.Join(keyDir, keyFileName), []byte(primaryKey))
+}
+
+// writeFileAtomic writes data to a temporary file first and renames it into place,
+// so a crash never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// readKeyFile returns the primary key stored in an encoded key directory.
+func readKeyFile(keyDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, keyFileName))
+	if err != nil {
+		return "", err
+	}
+	primaryKey := string(data)
+	if encodeKey(primaryKey) != filepath.Base(keyDir) {
+		return "", fmt.Errorf("key file in %s does not match its directory", keyDir)
+	}
+	return primaryKey, nil
+}
+
+// isEncodedKeyDir reports whether dir is a key directory in the encoded layout.
+func isEncodedKeyDir(dir string) bool {
+	_, err := readKeyFile(dir)
+	return err == nil
+}
+
+// migrateLegacyKeys moves key directories created before keys were encoded
+// (basePath/<primaryKey>/data.bin) to their encoded location. Keys containing
+// separators used to create nested directories, so the primary key is recovered
+// from the whole path relative to basePath rather than from the last element.
+func (ng *NumberGenerator) migrateLegacyKeys() error {
+	var legacyDirs []string
+	err := filepath.Walk(ng.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == restoreDirName {
+			return filepath.SkipDir // Staging area of an interrupted Restore
+		}
+		if info.IsDir() || filepath.Base(path) != "data.bin" {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		if dir != ng.basePath && !isEncodedKeyDir(dir) {
+			legacyDirs = append(legacyDirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Move the deepest directories first so that a legacy key nested inside another
+	// legacy key (e.g. "a/b" inside "a") is moved out before its parent.
+	sort.Slice(legacyDirs, func(i, j int) bool {
+		return len(legacyDirs[i]) > len(legacyDirs[j])
+	})
+
+	for _, dir := range legacyDirs {
+		rel, err := filepath.Rel(ng.basePath, dir)
+		if err != nil {
+			return err
+		}
+		primaryKey := filepath.ToSlash(rel)
+		if err := validateKey(primaryKey); err != nil {
+			return fmt.Errorf("migrating %s: %w", dir, err)
+		}
+
+		// Write the key file before moving, so the rename is the only step that
+		// commits the migration. A crash before it leaves a legacy directory that is
+		// migrated again, since its name does not match the key file.
+		if err := writeKeyFile(dir, primaryKey); err != nil {
+			return fmt.Errorf("migrating %s: %w", dir, err)
+		}
+		if err := ng.moveKeyDir(dir, ng.buildKeyPath(primaryKey)); err != nil {
+			return fmt.Errorf("migrating %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
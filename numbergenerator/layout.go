@@ -0,0 +1,111 @@
+package numbergenerator
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	layoutFileName = "LAYOUT" // Records the layout of basePath, see prepareLayout
+
+	maxFanOut = 4
+)
+
+// prepareLayout makes sure every key directory under basePath sits where the
+// configured layout expects it. The layout is recorded in a LAYOUT file, so the
+// directory tree is only walked when the layout changed or the base path predates
+// the file.
+func (ng *NumberGenerator) prepareLayout() error {
+	layoutFile := filepath.Join(ng.basePath, layoutFileName)
+	layout := fmt.Sprintf("fanout=%d\n", ng.fanOut)
+	if data, err := os.ReadFile(layoutFile); err == nil && string(data) == layout {
+		return nil
+	}
+	if ng.readOnly {
+		return fmt.Errorf("%s does not match %q, open it read-write once to migrate it", layoutFile, layout)
+	}
+
+	if err := ng.migrateLegacyKeys(); err != nil {
+		return err
+	}
+	if err := ng.relocateKeys(); err != nil {
+		return err
+	}
+	return writeFileAtomic(layoutFile, []byte(layout))
+}
+
+// walkKeys calls fn for every encoded key directory under basePath, without
+// descending into the key directories themselves.
+func (ng *NumberGenerator) walkKeys(fn func(primaryKey, dir string) error) error {
+	return filepath.WalkDir(ng.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == ng.basePath {
+			return nil
+		}
+		if d.Name() == restoreDirName {
+			return filepath.SkipDir // Staging area of an interrupted Restore
+		}
+
+		primaryKey, err := readKeyFile(path)
+		if err != nil {
+			return nil // Not a key directory, e.g. a fan-out level
+		}
+		if err := fn(primaryKey, path); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// relocateKeys moves key directories written with a different fan-out to the
+// location expected by the current one.
+func (ng *NumberGenerator) relocateKeys() error {
+	moves := make(map[string]string)
+	err := ng.walkKeys(func(primaryKey, dir string) error {
+		if target := ng.buildKeyPath(primaryKey); target != dir {
+			moves[dir] = target
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for dir, target := range moves {
+		if err := ng.moveKeyDir(dir, target); err != nil {
+			return fmt.Errorf("relocating %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// moveKeyDir renames a key directory to target, creating the fan-out directories
+// above target and removing the ones left empty above dir.
+func (ng *NumberGenerator) moveKeyDir(dir, target string) error {
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, target); err != nil {
+		return err
+	}
+	ng.removeEmptyParents(dir)
+	return nil
+}
+
+// removeEmptyParents removes the directories between dir and basePath that are
+// left empty after dir was moved or deleted.
+func (ng *NumberGenerator) removeEmptyParents(dir string) {
+	// os.Remove refuses to delete non-empty directories, which ends the loop.
+	for parent := filepath.Dir(dir); parent != ng.basePath; parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package numbergenerator
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"queueguard/metrics"
+)
+
+// generatorMetrics holds the instruments updated by a generator. All of them are
+// nil unless WithMetrics is used, and nil instruments ignore updates.
+type generatorMetrics struct {
+	appendLatency *metrics.Histogram
+	updateLatency *metrics.Histogram
+	fsyncLatency  *metrics.Histogram
+	ifMatchHits   *metrics.Counter
+	ifMatchMisses *metrics.Counter
+	backlog       *backlogGauge
+}
+
+// WithMetrics registers the generator's metrics with reg:
+//
+//	queueguard_backlog{key,group}            records above the watermark, per stream
+//	queueguard_append_duration_seconds       AppendRecord latency
+//	queueguard_update_duration_seconds       UpdateStatuses latency
+//	queueguard_fsync_duration_seconds        fsync latency of stream files
+//	queueguard_open_files                    open file handles
+//	queueguard_update_if_match_total{result} UpdateStatusIfMatch hits and misses
+//
+// The backlog is kept up to date as headers are written. The stream headers are
+// read once, on the first scrape and on the first after a Restore.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(ng *NumberGenerator) {
+		ng.metrics = generatorMetrics{
+			appendLatency: reg.NewHistogram("queueguard_append_duration_seconds", "Time taken by AppendRecord.", nil),
+			updateLatency: reg.NewHistogram("queueguard_update_duration_seconds", "Time taken by UpdateStatuses.", nil),
+			fsyncLatency:  reg.NewHistogram("queueguard_fsync_duration_seconds", "Time taken to fsync stream files.", nil),
+			ifMatchHits: reg.NewCounter("queueguard_update_if_match_total",
+				"UpdateStatusIfMatch calls by whether the number was next in line.", metrics.Label{Name: "result", Value: "hit"}),
+			ifMatchMisses: reg.NewCounter("queueguard_update_if_match_total",
+				"UpdateStatusIfMatch calls by whether the number was next in line.", metrics.Label{Name: "result", Value: "miss"}),
+			backlog: &backlogGauge{rescan: true},
+		}
+		reg.NewGaugeFunc("queueguard_open_files", "File handles held open by the generator.", func() float64 {
+			return float64(ng.CacheStats().Open)
+		})
+		reg.NewCollector("queueguard_backlog", "Records above the watermark of a stream.", ng.collectBacklog)
+	}
+}
+
+// backlogGauge holds TotalRecords minus the watermark of every stream. A nil
+// gauge ignores updates.
+type backlogGauge struct {
+	mu      sync.Mutex
+	streams map[stream]uint64
+	rescan  bool // The streams must be read before the next scrape
+}
+
+// set records the header just written to a stream. The caller must hold the
+// stream's lock, which keeps the updates of a stream in order.
+func (b *backlogGauge) set(s stream, header FileHeader) {
+	if b == nil {
+		return
+	}
+	backlog := uint64(0)
+	if header.TotalRecords > header.LastUpdated {
+		backlog = header.TotalRecords - header.LastUpdated
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streams == nil {
+		b.streams = make(map[stream]uint64)
+	}
+	b.streams[s] = backlog
+}
+
+// reset forgets all streams after their data was replaced, and has the next scrape
+// read them again.
+func (b *backlogGauge) reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.streams = nil
+	b.rescan = true
+}
+
+// collectBacklog emits the backlog of every stream, reading the stream headers
+// first if they were not read yet.
+func (ng *NumberGenerator) collectBacklog(emit func(float64, ...metrics.Label)) error {
+	b := ng.metrics.backlog
+	b.mu.Lock()
+	rescan := b.rescan
+	b.rescan = false
+	b.mu.Unlock()
+	if rescan {
+		err := ng.walkStreams(func(s stream) error {
+			// The stream's lock keeps set from running in between.
+			defer ng.lockStream(s)()
+			header, err := ng.readHeaderLocked(s)
+			if err == io.EOF {
+				return nil // Nothing was appended yet
+			}
+			if err == nil {
+				b.set(s, header)
+			}
+			return err
+		})
+		if err != nil {
+			b.mu.Lock()
+			b.rescan = true
+			b.mu.Unlock()
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s, backlog := range b.streams {
+		emit(float64(backlog), metrics.Label{Name: "key", Value: s.primaryKey}, metrics.Label{Name: "group", Value: s.group})
+	}
+	return nil
+}
+
+// readHeader locks a stream and reads its header.
+func (ng *NumberGenerator) readHeader(s stream) (FileHeader, error) {
+	defer ng.lockStream(s)()
+	return ng.readHeaderLocked(s)
+}
+
+// syncFile flushes a file to disk and records how long it took.
+func (ng *NumberGenerator) syncFile(file *os.File) error {
+	start := time.Now()
+	err := file.Sync()
+	ng.metrics.fsyncLatency.ObserveSince(start)
+	return err
+}
@@ -0,0 +1,418 @@
+package numbergenerator
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	intentsDirName = "intents" // Intent logs of AppendMulti calls in progress
+	intentFileExt  = ".intent"
+)
+
+// ErrIntentPending is returned for appends to a key whose AppendMulti failed
+// halfway and could not be completed yet. Appending to the key first would make
+// the records of the failed call impossible to complete.
+var ErrIntentPending = errors.New("an interrupted AppendMulti is pending for the key")
+
+// intent records the records an AppendMulti call is about to write, so a crash
+// halfway through can be completed on the next start.
+type intent struct {
+	ID      string        `json:"id"`
+	Time    time.Time     `json:"time"`
+	Entries []intentEntry `json:"entries"`
+}
+
+type intentEntry struct {
+	Key      string `json:"key"`
+	Number   uint64 `json:"number"`
+	Status   byte   `json:"status"`
+	Filename string `json:"filename"`
+}
+
+// AppendMulti appends one record to each of the given keys as a single unit and
+// returns their numbers in the order of keys. Either every key receives its record
+// or, if AppendMulti fails before writing anything, none does; a crash in between
+// is completed from the intent log when the generator is opened again. If writing
+// fails halfway, the keys take no other appends, which fail with ErrIntentPending,
+// until the call is completed by a later append to one of them or on the next start.
+//
+// Keys are locked in sorted order, so concurrent AppendMulti calls over
+// overlapping keys cannot deadlock. The call fails with a *WindowFullError if any
+// of the keys' windows is full, and with a *RateLimitError if any key is rate limited.
+func (ng *NumberGenerator) AppendMulti(keys []string, status byte) (result []uint64, err error) {
+	if ng.readOnly {
+		return nil, ErrReadOnly
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for i, key := range sorted {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+		if i > 0 && sorted[i-1] == key {
+			return nil, fmt.Errorf("key %q appears more than once", key)
+		}
+	}
+	if err := ng.retryIntents(sorted...); err != nil {
+		return nil, err
+	}
+
+	// Tokens are given back unless the records are written, see below.
+	var charged []string
+	written := false
+	defer func() {
+		if !written {
+			for _, key := range charged {
+				ng.refundTokens(key, opAppend, 1)
+			}
+		}
+	}()
+	for _, key := range sorted {
+		if err := ng.takeTokens(context.Background(), key, opAppend, 1, false); err != nil {
+			return nil, err
+		}
+		charged = append(charged, key)
+	}
+	defer ng.metrics.appendLatency.ObserveSince(time.Now())
+
+	defer ng.lockKeys(sorted)(&err)
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	in := intent{ID: id.String(), Time: time.Now()}
+	numbers := make(map[string]uint64, len(keys))
+	for _, key := range sorted {
+		s := stream{primaryKey: key}
+		if err := ng.checkFence(s); err != nil {
+			return nil, err
+		}
+		if err := ng.checkWindowLocked(s); err != nil {
+			return nil, err
+		}
+		total, err := ng.totalRecordsLocked(s)
+		if err != nil {
+			return nil, err
+		}
+		filename, err := uuid.NewRandom()
+		if err != nil {
+			return nil, err
+		}
+		numbers[key] = total + 1
+		in.Entries = append(in.Entries, intentEntry{Key: key, Number: total + 1, Status: status, Filename: filename.String()})
+	}
+
+	// From here on the records are written no matter what: if applying them fails,
+	// the keys are fenced off until the intent is completed, by the next append to
+	// one of them or on the next start.
+	path, err := ng.writeIntent(in)
+	if err != nil {
+		return nil, err
+	}
+	written = true
+	if err := ng.completeIntentLocked(in, path); err != nil {
+		ng.fenceIntent(in, path)
+		return nil, fmt.Errorf("appending %s, fenced off its keys until it completes: %w", in.ID, err)
+	}
+
+	result = make([]uint64, len(keys))
+	for i, key := range keys {
+		result[i] = numbers[key]
+	}
+	return result, ng.publishIntent(in)
+}
+
+// lockKeys locks the default streams of keys, which must be sorted, and returns
+// the function releasing them and waiting for the hooks, like lockMutation.
+func (ng *NumberGenerator) lockKeys(keys []string) func(err *error) {
+	// Hold the barrier once for all keys; taking it again per key could deadlock
+	// against a waiting Restore.
+	ng.barrier.RLock()
+	streams := make([]stream, 0, len(keys))
+	locks := make([]*sync.Mutex, 0, len(keys))
+	for _, key := range keys {
+		s := stream{primaryKey: key}
+		lock := ng.streamLock(s)
+		lock.Lock()
+		streams = append(streams, s)
+		locks = append(locks, lock)
+	}
+	return func(err *error) {
+		waits := ng.takeHookWaits(streams...)
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+		ng.barrier.RUnlock()
+		if *err == nil {
+			*err = runHookWaits(waits)
+		}
+	}
+}
+
+// completeIntentLocked applies an intent and removes its file. It may be called
+// again for an intent that was completed partially. The caller must hold the
+// locks of all streams involved.
+func (ng *NumberGenerator) completeIntentLocked(in intent, path string) error {
+	if err := ng.applyIntentLocked(in); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// publishIntent publishes the records of a completed intent.
+func (ng *NumberGenerator) publishIntent(in intent) error {
+	for _, entry := range in.Entries {
+		m := Mutation{Type: MutationAppend, Key: entry.Key, Time: in.Time, Number: entry.Number, Status: entry.Status, Filename: entry.Filename}
+		if err := ng.publish(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingIntent is an intent whose AppendMulti call failed to apply it.
+type pendingIntent struct {
+	intent
+	path string
+}
+
+// fenceIntent keeps appends away from the keys of an intent that failed to apply,
+// so that they keep the record counts the intent expects.
+func (ng *NumberGenerator) fenceIntent(in intent, path string) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if ng.fences == nil {
+		ng.fences = make(map[string]*pendingIntent)
+	}
+	pending := &pendingIntent{intent: in, path: path}
+	for _, entry := range in.Entries {
+		ng.fences[entry.Key] = pending
+	}
+}
+
+// checkFence fails with ErrIntentPending if a failed AppendMulti is pending for
+// the stream. The caller must hold the stream's lock.
+func (ng *NumberGenerator) checkFence(s stream) error {
+	if s.group != "" {
+		return nil // AppendMulti only appends to default streams
+	}
+	ng.lock.Lock()
+	pending := ng.fences[s.primaryKey]
+	ng.lock.Unlock()
+	if pending == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %q waits for intent %s", ErrIntentPending, s.primaryKey, pending.ID)
+}
+
+// retryIntents tries to complete the failed AppendMulti calls pending for any of
+// keys. The caller must not hold any stream lock.
+func (ng *NumberGenerator) retryIntents(keys ...string) error {
+	for _, key := range keys {
+		ng.lock.Lock()
+		pending := ng.fences[key]
+		ng.lock.Unlock()
+		if pending == nil {
+			continue
+		}
+
+		sorted := make([]string, 0, len(pending.Entries))
+		for _, entry := range pending.Entries {
+			sorted = append(sorted, entry.Key)
+		}
+		sort.Strings(sorted)
+		completed, err := func() (completed bool, err error) {
+			defer ng.lockKeys(sorted)(&err)
+			ng.lock.Lock()
+			current := ng.fences[key]
+			ng.lock.Unlock()
+			if current != pending {
+				return false, nil // Completed by another call in the meantime
+			}
+			if err := ng.completeIntentLocked(pending.intent, pending.path); err != nil {
+				return false, err
+			}
+			ng.lock.Lock()
+			for _, k := range sorted {
+				delete(ng.fences, k)
+			}
+			ng.lock.Unlock()
+			ng.logger.Info("completed failed AppendMulti", "intent", pending.ID, "keys", len(pending.Entries))
+			return true, ng.publishIntent(pending.intent)
+		}()
+		if err != nil && !completed {
+			return fmt.Errorf("%w: %q waits for intent %s: %v", ErrIntentPending, key, pending.ID, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropFences forgets the failed AppendMulti calls, after Restore replaced the
+// data they refer to.
+func (ng *NumberGenerator) dropFences() {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	ng.fences = nil
+}
+
+// writeIntent durably stores an intent and returns its path.
+func (ng *NumberGenerator) writeIntent(in intent) (string, error) {
+	dir := filepath.Join(ng.basePath, intentsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, in.ID+intentFileExt)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := ng.syncFile(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(path+".tmp", path)
+}
+
+// applyIntentLocked writes every record of an intent that is not on disk yet and
+// flushes the streams. The caller must hold the locks of all streams involved.
+func (ng *NumberGenerator) applyIntentLocked(in intent) error {
+	for _, entry := range in.Entries {
+		s := stream{primaryKey: entry.Key}
+		total, err := ng.totalRecordsLocked(s)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case total == entry.Number-1:
+			if _, err := ng.appendLocked(s, entry.Status, entry.Filename, nil, in.Time); err != nil {
+				return err
+			}
+		case total >= entry.Number:
+			// The header was written before the crash, the record may not have been.
+			name, err := ng.filenameLocked(s, entry.Number)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if name != entry.Filename {
+				if total != entry.Number {
+					return fmt.Errorf("record %d of %q was overwritten after intent %s", entry.Number, entry.Key, in.ID)
+				}
+				if err := ng.writeRecordLocked(s, entry.Number, entry.Status, entry.Filename, in.Time); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("intent %s expects %q to hold %d records, it holds %d", in.ID, entry.Key, entry.Number-1, total)
+		}
+
+		file, err := ng.ensureFileOpen(s)
+		if err != nil {
+			return err
+		}
+		if err := ng.syncFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecordLocked overwrites the record in slot number. The caller must hold
+// the stream's lock.
+func (ng *NumberGenerator) writeRecordLocked(s stream, number uint64, status byte, name string, at time.Time) error {
+	if err := ng.setDependenciesLocked(s, number, nil); err != nil {
+		return err
+	}
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err
+	}
+	record := NumberStatusFilename{Number: number, Status: status}
+	copy(record.Filename[:], name)
+	if _, err := file.Seek(headerSize+int64(number-1)*recordSize, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(file, binary.BigEndian, &record); err != nil {
+		return err
+	}
+	return ng.setAppendedAt(s, number, at)
+}
+
+// recoverIntents completes the AppendMulti calls interrupted by a crash. It runs
+// while the generator is opened, before any other call can touch the streams.
+func (ng *NumberGenerator) recoverIntents() error {
+	dir := filepath.Join(ng.basePath, intentsDirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			// The intent was never complete, so nothing was written for it.
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), intentFileExt) {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var in intent
+		if err := json.Unmarshal(data, &in); err != nil {
+			return fmt.Errorf("reading intent %s: %w", path, err)
+		}
+		if err := ng.applyIntentLocked(in); err != nil {
+			return fmt.Errorf("recovering intent %s: %w", path, err)
+		}
+		ng.logger.Info("completed interrupted AppendMulti", "intent", in.ID, "keys", len(in.Entries))
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
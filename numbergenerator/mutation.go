@@ -0,0 +1,322 @@
+package numbergenerator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMutation is returned by ApplyMutation for a mutation it rejects for
+// what the mutation says rather than for a local failure, so every replica
+// rejects it alike.
+var ErrInvalidMutation = errors.New("invalid mutation")
+
+// MutationType names a change made to a stream.
+type MutationType string
+
+const (
+	MutationAppend         MutationType = "append"          // A record was appended
+	MutationUpdateStatuses MutationType = "update_statuses" // Records were marked as done
+	MutationRewind         MutationType = "rewind"          // Records after Number were reset to pending
+	MutationImport         MutationType = "import"          // The stream was replaced with Records by Import
+	MutationRestore        MutationType = "restore"         // All data was replaced by Restore; Key is empty
+)
+
+// Mutation describes a single change to a stream. Mutations are passed to the
+// hooks registered with AddMutationHook and can be replayed on another generator
+// with ApplyMutation, which is how replicas are kept in sync.
+type Mutation struct {
+	Type  MutationType `json:"type"`
+	Key   string       `json:"key"`
+	Group string       `json:"group,omitempty"`
+	Time  time.Time    `json:"time"`
+
+	// Set for MutationUpdateStatuses and MutationRewind that change the progress
+	// of a consumer group instead of the stream.
+	Consumer string `json:"consumer,omitempty"`
+
+	// Set for MutationAppend and MutationRewind.
+	Number   uint64 `json:"number,omitempty"`
+	Status   byte   `json:"status,omitempty"`
+	Filename string `json:"filename,omitempty"`
+
+	// Set for MutationAppend of a record appended with AppendRecordAfter.
+	DependsOn []Dependency `json:"depends_on,omitempty"`
+
+	// Set for MutationUpdateStatuses.
+	Numbers []uint64 `json:"numbers,omitempty"`
+
+	// Set for MutationImport.
+	Watermark uint64           `json:"watermark,omitempty"`
+	Records   []ImportedRecord `json:"records,omitempty"`
+}
+
+// MutationHook is called after a mutation was written to disk.
+type MutationHook func(Mutation) error
+
+// MutationWaitHook is a MutationHook that may return a function waiting for
+// something the mutation started, e.g. for replicas to acknowledge it. The
+// function is called once the stream was unlocked, so the wait does not hold up
+// other operations on the stream, and its error is returned to the caller of the
+// mutating method.
+type MutationWaitHook func(Mutation) (wait func() error, err error)
+
+// AddMutationHook registers fn to be called with every mutation applied to the
+// generator, including those passed to ApplyMutation. Hooks run while the stream
+// is still locked, so they see the mutations of each stream in order; a
+// MutationRestore is passed while Restore still holds all streams. An error
+// returned by a hook is returned to the caller of the mutating method, but the
+// mutation itself has already been written.
+func (ng *NumberGenerator) AddMutationHook(fn MutationHook) {
+	ng.AddMutationWaitHook(func(m Mutation) (func() error, error) {
+		return nil, fn(m)
+	})
+}
+
+// AddMutationWaitHook registers fn like AddMutationHook, and lets the caller of
+// the mutating method wait for the function fn returns.
+func (ng *NumberGenerator) AddMutationWaitHook(fn MutationWaitHook) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	ng.hooks = append(ng.hooks, fn)
+}
+
+// publish passes a mutation to all hooks. The waits they return are run by the
+// function returned by lockMutation. The caller must hold the stream's lock.
+func (ng *NumberGenerator) publish(m Mutation) error {
+	ng.lock.Lock()
+	hooks := ng.hooks
+	ng.lock.Unlock()
+
+	s := stream{primaryKey: m.Key, group: m.Group}
+	for _, hook := range hooks {
+		wait, err := hook(m)
+		if wait != nil {
+			ng.lock.Lock()
+			if ng.hookWaits == nil {
+				ng.hookWaits = make(map[stream][]func() error)
+			}
+			ng.hookWaits[s] = append(ng.hookWaits[s], wait)
+			ng.lock.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockMutation is lockStream for operations that publish mutations. The returned
+// function releases the lock and then waits for the hooks, and sets *err to the
+// first wait that failed unless it is set already.
+func (ng *NumberGenerator) lockMutation(s stream) func(err *error) {
+	unlock := ng.lockStream(s)
+	return func(err *error) {
+		waits := ng.takeHookWaits(s)
+		unlock()
+		if *err == nil {
+			*err = runHookWaits(waits)
+		}
+	}
+}
+
+// takeHookWaits removes the waits of the mutations published for the streams and
+// returns them. The caller must hold the streams' locks, so the waits of the next
+// operation are not taken with them.
+func (ng *NumberGenerator) takeHookWaits(streams ...stream) []func() error {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+
+	var waits []func() error
+	for _, s := range streams {
+		waits = append(waits, ng.hookWaits[s]...)
+		delete(ng.hookWaits, s)
+	}
+	return waits
+}
+
+func runHookWaits(waits []func() error) error {
+	for _, wait := range waits {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyMutation replays a mutation recorded on another generator. Appends carry
+// their number and are skipped when the record already exists, so replaying a
+// mutation twice is harmless; an append that would leave a gap is rejected.
+//
+// An append without a number is appended as the next record of its stream, unless
+// the last record already carries its filename. Re-applying such a mutation right
+// after it was applied, e.g. after a crash, is therefore harmless as well.
+//
+// Mutations that can never be applied, wherever they are replayed, are rejected
+// with an error wrapping ErrInvalidMutation. Any other error is a failure of
+// this generator, e.g. of its storage.
+func (ng *NumberGenerator) ApplyMutation(m Mutation) (err error) {
+	if err := validateMutation(m); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMutation, err)
+	}
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+	if m.Type == MutationImport {
+		return ng.applyImport(m) // Locks the stream only to swap the files in
+	}
+	s := stream{primaryKey: m.Key, group: m.Group}
+	defer ng.lockMutation(s)(&err)
+
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case MutationAppend:
+		if m.Number == 0 {
+			if total > 0 {
+				name, err := ng.filenameLocked(s, total)
+				if err != nil {
+					return err
+				}
+				if name == m.Filename {
+					return nil // Already applied
+				}
+			}
+			m.Number = total + 1
+		}
+		if m.Number <= total {
+			return nil // Already applied
+		}
+		if m.Number != total+1 {
+			return fmt.Errorf("%w: cannot apply record %d to %q with %d records", ErrInvalidMutation, m.Number, s.cacheKey(), total)
+		}
+		if _, err := ng.appendLocked(s, m.Status, m.Filename, m.DependsOn, m.Time); err != nil {
+			return err
+		}
+	case MutationUpdateStatuses:
+		if len(m.Numbers) == 0 {
+			return nil
+		}
+		for _, number := range m.Numbers {
+			if number == 0 || number > total {
+				return fmt.Errorf("%w: record %d of %q does not exist", ErrInvalidMutation, number, s.cacheKey())
+			}
+		}
+		if m.Consumer != "" {
+			if err := ng.updateConsumerLocked(s, m.Consumer, m.Numbers, m.Time); err != nil {
+				return err
+			}
+		} else if err := ng.updateStatusesLocked(s, m.Numbers, m.Time); err != nil {
+			return err
+		}
+	case MutationRewind:
+		if m.Number > total {
+			return fmt.Errorf("%w: cannot rewind %q to %d, it has %d records", ErrInvalidMutation, s.cacheKey(), m.Number, total)
+		}
+		if m.Consumer != "" {
+			if err := ng.rewindConsumerLocked(s, m.Consumer, m.Number, m.Time); err != nil {
+				return err
+			}
+		} else if err := ng.rewindLocked(s, m.Number, m.Time); err != nil {
+			return err
+		}
+	}
+
+	return ng.publish(m)
+}
+
+// validateMutation checks what ApplyMutation can check without reading the stream.
+func validateMutation(m Mutation) error {
+	switch m.Type {
+	case MutationAppend, MutationUpdateStatuses, MutationRewind, MutationImport:
+	case MutationRestore:
+		return fmt.Errorf("%s mutation cannot be applied, the replica needs a snapshot", m.Type)
+	default:
+		return fmt.Errorf("unknown mutation type %q", m.Type)
+	}
+	if err := validateKey(m.Key); err != nil {
+		return err
+	}
+	if m.Group != "" {
+		if err := validateGroupID(m.Group); err != nil {
+			return err
+		}
+	}
+	s := stream{primaryKey: m.Key, group: m.Group}
+	if err := validateDependencies(s, m.DependsOn); err != nil {
+		return err
+	}
+	if m.Consumer != "" {
+		if err := validateName("consumer name", m.Consumer); err != nil {
+			return err
+		}
+		if m.Group != "" || m.Type == MutationAppend || m.Type == MutationImport {
+			return fmt.Errorf("%s mutation of %q cannot belong to consumer group %q", m.Type, s.cacheKey(), m.Consumer)
+		}
+	}
+	if m.Type == MutationImport {
+		total := uint64(len(m.Records))
+		if m.Watermark > total {
+			return fmt.Errorf("last_updated %d exceeds total_records %d", m.Watermark, total)
+		}
+		for i, record := range m.Records {
+			if err := validateImportedRecord(s, uint64(i)+1, total, record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// totalRecordsLocked returns the number of records of a stream, 0 if it does not
+// exist yet. The caller must hold the stream's lock.
+func (ng *NumberGenerator) totalRecordsLocked(s stream) (uint64, error) {
+	if _, err := os.Stat(ng.buildStreamPath(s)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	header, err := ng.readHeaderLocked(s)
+	if err == io.EOF {
+		return 0, nil
+	}
+	return header.TotalRecords, err
+}
+
+// readHeaderLocked reads the header of a stream. A stream nothing was appended to
+// is not created; the error satisfies os.IsNotExist. The caller must hold the
+// stream's lock.
+func (ng *NumberGenerator) readHeaderLocked(s stream) (FileHeader, error) {
+	header := FileHeader{}
+
+	file, err := ng.openCachedFile(s, ng.buildStreamPath(s), false)
+	if err != nil {
+		return header, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return header, err
+	}
+	err = binary.Read(file, binary.BigEndian, &header)
+	return header, err
+}
+
+// filenameLocked returns the filename of a record. The caller must hold the stream's lock.
+func (ng *NumberGenerator) filenameLocked(s stream, number uint64) (string, error) {
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(headerSize+(int64(number)-1)*recordSize, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var record NumberStatusFilename
+	if err := binary.Read(file, binary.BigEndian, &record); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(record.Filename[:]), "\x00"), nil
+}
@@ -1,14 +1,22 @@
 package numbergenerator
 
 import (
+	"container/list"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+
+	vmoformat "queueguard/vmofile"
 )
 
 type FileHeader struct {
@@ -31,61 +39,139 @@ type NumberGenerator struct {
 	basePath  string
 	locks     map[string]*sync.Mutex
 	lock      sync.Mutex
-	fileCache map[string]*os.File
+	barrier   sync.RWMutex             // Held for writing by Restore, see lockStream
+	fileCache map[string]*list.Element // Keyed by path, values are *cachedFile ordered by lru
+	lru       *list.List               // Most recently used file at the front
+	fanOut    int                      // Number of hash-prefix directory levels above each key directory
+
+	maxOpenFiles int // Upper bound for len(fileCache), 0 means unlimited
+	cacheStats   CacheStats
+
+	readOnly bool
+	dirLock  *os.File // Holds the flock on basePath/LOCK
+
+	segments  *vmoformat.VMOFiles // Included in snapshots when set
+	hooks     []MutationWaitHook
+	hookWaits map[stream][]func() error // Requested by hooks, run once the stream is unlocked
+
+	stallConfig   *StallDetectorConfig // Set by WithStallDetector
+	stallDetector *stallDetector
+
+	watchMu  sync.Mutex
+	watchers map[stream]map[*watcher]bool // Subscriptions created by Watch
+
+	metrics generatorMetrics
+	tracer  Tracer
+	logger  *slog.Logger
+
+	defaultWindow uint64            // Set by WithWindow, 0 means unbounded
+	windows       map[string]uint64 // Per-key overrides set by SetKeyWindow
+
+	rateMu    sync.Mutex
+	rateRules map[string]*rateRule // Keyed by selector, see SetRateLimits
+
+	deps    map[stream]map[uint64][]Dependency // Loaded dependencies files, see loadDependenciesLocked
+	rewinds atomic.Uint64                      // Bumped before a watermark moves back, see dependenciesMet
+
+	global *globalLog // Set by WithGlobalSequence
+
+	fences map[string]*pendingIntent // Keys of failed AppendMulti calls, see fenceIntent
+
+	turns    map[turnKey]chan struct{}  // Held by ProcessInOrder, see acquireTurn
+	failures map[turnKey]processFailure // Last failure of ProcessInOrder, reported by Gaps
 }
 
-func NewNumberGenerator(basePath string) *NumberGenerator {
-	// Check if the base directory exists; if not, create it.
-	if _, err := os.Stat(basePath); os.IsNotExist(err) {
-		err := os.MkdirAll(basePath, 0755)
-		if err != nil {
-			panic(err)
-		}
+// stream identifies one ordered sequence stored under a primary key: either the
+// key's default sequence (empty group) or one of its message groups.
+type stream struct {
+	primaryKey string
+	group      string
+}
+
+// cacheKey returns the key used for the stream in the locks and fileCache maps.
+// The default stream keeps using the bare primary key.
+func (s stream) cacheKey() string {
+	if s.group == "" {
+		return s.primaryKey
 	}
+	return s.primaryKey + "\x00" + s.group
+}
+
+// NewNumberGenerator opens the generator stored in basePath, creating the
+// directory if necessary. It fails if the options are invalid, the base path is
+// locked by another process or existing keys cannot be brought in line with the
+// configured layout.
+func NewNumberGenerator(basePath string, opts ...Option) (*NumberGenerator, error) {
+	basePath = filepath.Clean(basePath)
 
 	// Initialize the NumberGenerator.
 	ng := &NumberGenerator{
 		basePath:  basePath,
 		locks:     make(map[string]*sync.Mutex),
-		fileCache: make(map[string]*os.File),
+		fileCache: make(map[string]*list.Element),
+		lru:       list.New(),
+		tracer:    noopTracer{},
+		logger:    slog.Default(),
+		deps:      make(map[stream]map[uint64][]Dependency),
+	}
+	for _, opt := range opts {
+		opt(ng)
+	}
+	if ng.maxOpenFiles < 0 {
+		return nil, fmt.Errorf("max open files must not be negative, got %d", ng.maxOpenFiles)
+	}
+	if ng.fanOut < 0 || ng.fanOut > maxFanOut {
+		return nil, fmt.Errorf("fan-out must be between 0 and %d, got %d", maxFanOut, ng.fanOut)
 	}
 
-	// Open all existing files in the basePath directory.
-	err := filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
+	// Check if the base directory exists; if not, create it. A read-only generator
+	// has nothing to inspect without it.
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		if ng.readOnly {
+			return nil, err
+		}
+		err := os.MkdirAll(basePath, 0755)
 		if err != nil {
-			return err // Propagate errors encountered during walking.
+			return nil, err
 		}
+	}
+
+	// Make sure no other process writes to the same base path.
+	if err := ng.acquireDirLock(); err != nil {
+		return nil, err
+	}
 
-		// Skip directories and focus on files, specifically checking for 'data.bin' files.
-		if !info.IsDir() && filepath.Base(path) == "data.bin" {
-			// Extract primaryKey from the directory structure based on the basePath and file path.
-			// This assumes a specific directory structure: basePath/primaryKey/data.bin
-			primaryKey := filepath.Base(filepath.Dir(path))
-
-			// Open the file for reading and writing (but do not create it if it does not exist).
-			file, err := os.OpenFile(path, os.O_RDWR, 0666)
-			if err != nil {
-				return err // Return any error encountered opening the file.
-			}
-
-			// Store the file handle in the fileCache under its primaryKey.
-			ng.fileCache[primaryKey] = file
-
-			// Initialize a lock for the primaryKey if it doesn't already exist.
-			if _, exists := ng.locks[primaryKey]; !exists {
-				ng.locks[primaryKey] = &sync.Mutex{}
-			}
+	// Bring existing key directories in line with the configured layout. Files are
+	// opened lazily by ensureFileOpen, so startup does not depend on the number of keys.
+	if err := ng.prepareLayout(); err != nil {
+		ng.Close()
+		return nil, fmt.Errorf("preparing %s: %w", basePath, err)
+	}
+
+	// Settle the global log before the interrupted AppendMulti calls add to it.
+	if ng.global != nil {
+		if err := ng.openGlobalLog(); err != nil {
+			ng.Close()
+			return nil, fmt.Errorf("opening the global log: %w", err)
 		}
+	}
 
-		return nil // Continue walking the directory tree.
-	})
+	// Complete the AppendMulti calls a crash interrupted.
+	if !ng.readOnly {
+		if err := ng.recoverIntents(); err != nil {
+			ng.Close()
+			return nil, err
+		}
+	}
 
-	// Check for errors during the walk.
-	if err != nil {
-		panic(err)
+	if ng.stallConfig != nil {
+		if err := ng.startStallDetector(); err != nil {
+			ng.Close()
+			return nil, err
+		}
 	}
 
-	return ng
+	return ng, nil
 }
 
 func getHeaderSize() int64 {
@@ -97,44 +183,120 @@ func getBodySize() int64 {
 }
 
 func (ng *NumberGenerator) buildFilePath(primaryKey string) string {
-	return filepath.Join(ng.basePath, primaryKey, "data.bin")
+	return filepath.Join(ng.buildKeyPath(primaryKey), "data.bin")
+}
+
+// buildStreamPath returns the data file of a stream. The default stream lives in
+// data.bin, message groups live next to it in the groups directory.
+func (ng *NumberGenerator) buildStreamPath(s stream) string {
+	if s.group == "" {
+		return ng.buildFilePath(s.primaryKey)
+	}
+	return filepath.Join(ng.buildGroupsPath(s.primaryKey), s.group+groupFileExt)
+}
+
+// buildGroupsPath returns the directory holding the message groups of a key.
+func (ng *NumberGenerator) buildGroupsPath(primaryKey string) string {
+	return filepath.Join(ng.buildKeyPath(primaryKey), groupsDir)
+}
+
+// streamLock returns the mutex serialising access to a stream's file, creating it on
+// first use. The lock must be held while using the handle returned by ensureFileOpen.
+func (ng *NumberGenerator) streamLock(s stream) *sync.Mutex {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+
+	lock, exists := ng.locks[s.cacheKey()]
+	if !exists {
+		lock = &sync.Mutex{} // Initialize a new mutex if one does not exist
+		ng.locks[s.cacheKey()] = lock
+	}
+	return lock
+}
+
+// lockStream locks a stream for the duration of one operation and returns the
+// function releasing it. Operations also hold the barrier for reading, so Restore
+// can wait for all of them to finish before replacing the files.
+func (ng *NumberGenerator) lockStream(s stream) func() {
+	ng.barrier.RLock()
+	lock := ng.streamLock(s)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		ng.barrier.RUnlock()
+	}
+}
+
+// ensureFileOpen returns the cached handle of a stream's data file, opening it if
+// necessary. The caller must hold the stream's lock.
+func (ng *NumberGenerator) ensureFileOpen(s stream) (*os.File, error) {
+	return ng.ensureCachedFile(s, ng.buildStreamPath(s))
+}
+
+// ensureCachedFile returns the cached handle of filePath, which is one of the files
+// belonging to stream s. The caller must hold the stream's lock.
+func (ng *NumberGenerator) ensureCachedFile(s stream, filePath string) (*os.File, error) {
+	return ng.openCachedFile(s, filePath, true)
 }
 
-func (ng *NumberGenerator) ensureFileOpen(primaryKey string) error {
+// openCachedFile is ensureCachedFile creating a missing file only if create is
+// set; readers pass false and get an error satisfying os.IsNotExist instead.
+func (ng *NumberGenerator) openCachedFile(s stream, filePath string, create bool) (*os.File, error) {
+	if err := validateKey(s.primaryKey); err != nil {
+		return nil, err
+	}
+
 	ng.lock.Lock()
 	defer ng.lock.Unlock()
 
 	// Check if the file is already opened and cached.
-	if _, exists := ng.fileCache[primaryKey]; !exists {
-		// Construct the file path.
-		filePath := ng.buildFilePath(primaryKey)
+	if elem, exists := ng.fileCache[filePath]; exists {
+		ng.cacheStats.Hits++
+		ng.lru.MoveToFront(elem)
+		return elem.Value.(*cachedFile).file, nil
+	}
+	ng.cacheStats.Misses++
 
-		// Open or create the file with read-write permissions.
-		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			return err
-		}
+	// Make room for the new handle before opening it.
+	ng.evictLocked()
 
-		// Cache the opened file.
-		ng.fileCache[primaryKey] = file
+	// Open or create the file with read-write permissions, or only open it for
+	// reading on a read-only generator.
+	flag := os.O_RDWR
+	if ng.readOnly {
+		flag = os.O_RDONLY
+	} else if create {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(filePath, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
 
-		// Ensure a corresponding lock is created for the new file.
-		if _, exists := ng.locks[primaryKey]; !exists {
-			ng.locks[primaryKey] = &sync.Mutex{}
-		}
+	// Cache the opened file.
+	ng.fileCache[filePath] = ng.lru.PushFront(&cachedFile{path: filePath, lockKey: s.cacheKey(), file: file})
+
+	// Ensure a corresponding lock is created for the new file.
+	if _, exists := ng.locks[s.cacheKey()]; !exists {
+		ng.locks[s.cacheKey()] = &sync.Mutex{}
 	}
-	return nil
+	return file, nil
 }
 
 func (ng *NumberGenerator) GetLastNumber(primaryKey string) (uint64, error) {
-	if err := ng.ensureFileOpen(primaryKey); err != nil {
+	return ng.getLastNumber(stream{primaryKey: primaryKey})
+}
+
+func (ng *NumberGenerator) getLastNumber(s stream) (uint64, error) {
+	defer ng.lockStream(s)()
+
+	// Make sure the file is open, then proceed with the logic.
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
 		return 0, err
 	}
 
-	// Now that the file is guaranteed to be open, proceed with the logic.
-	file := ng.fileCache[primaryKey]
-
-	_, err := file.Seek(0, io.SeekStart)
+	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
 		return 0, err
 	}
@@ -148,21 +310,108 @@ func (ng *NumberGenerator) GetLastNumber(primaryKey string) (uint64, error) {
 	return header.TotalRecords, nil
 }
 
+// AppendRecord appends a record to primaryKey and returns its number. It fails
+// with a *WindowFullError if the key's window is full, see WithWindow.
 func (ng *NumberGenerator) AppendRecord(primaryKey string, status byte) (uint64, error) {
-	// Ensure the locks map is initialized for the given primary key
-	ng.lock.Lock()
-	lock, exists := ng.locks[primaryKey]
-	if !exists {
-		lock = &sync.Mutex{} // Initialize a new mutex if one does not exist
-		ng.locks[primaryKey] = lock
+	return ng.appendRecord(context.Background(), stream{primaryKey: primaryKey}, status, nil, false)
+}
+
+// AppendRecordContext is AppendRecord traced as part of the trace in ctx. If the
+// key's window is full, it waits for the consumer to catch up until ctx is done.
+func (ng *NumberGenerator) AppendRecordContext(ctx context.Context, primaryKey string, status byte) (uint64, error) {
+	return ng.appendRecord(ctx, stream{primaryKey: primaryKey}, status, nil, true)
+}
+
+func (ng *NumberGenerator) appendRecord(ctx context.Context, s stream, status byte, deps []Dependency, wait bool) (number uint64, err error) {
+	_, span := ng.startSpan(ctx, "queueguard.AppendRecord", s)
+	defer func() {
+		span.SetAttributes(Attribute{"queueguard.number", number})
+		endSpan(span, err)
+	}()
+
+	if err := validateKey(s.primaryKey); err != nil {
+		return 0, err
+	}
+	if err := validateDependencies(s, deps); err != nil {
+		return 0, err
 	}
-	ng.lock.Unlock()
+	if ng.readOnly {
+		return 0, ErrReadOnly
+	}
+	defer ng.metrics.appendLatency.ObserveSince(time.Now())
 
-	lock.Lock() // Lock using the mutex specific to the primaryKey
-	defer lock.Unlock()
+	if s.group == "" {
+		if err := ng.retryIntents(s.primaryKey); err != nil {
+			return 0, err
+		}
+	}
+	if err := ng.takeTokens(ctx, s.primaryKey, opAppend, 1, wait); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if number == 0 {
+			ng.refundTokens(s.primaryKey, opAppend, 1) // Nothing was appended
+		}
+	}()
+
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		return 0, err
+	}
 
-	// Ensure base directory exists
-	basePath := ng.buildFilePath(primaryKey)
+	for {
+		number, err = ng.appendWithinWindow(s, status, newUUID.String(), deps)
+		var full *WindowFullError
+		if !wait || !errors.As(err, &full) {
+			return number, err
+		}
+
+		// Wait until the record fits, i.e. TotalRecords - watermark < window, then
+		// try again since other producers may have been faster.
+		span.SetAttributes(Attribute{"queueguard.throttled", true})
+		if _, err := ng.waitForWatermark(ctx, s, "", full.TotalRecords-full.Window+1); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// appendWithinWindow appends a record unless the stream's window is full.
+func (ng *NumberGenerator) appendWithinWindow(s stream, status byte, filename string, deps []Dependency) (_ uint64, err error) {
+	defer ng.lockMutation(s)(&err)
+
+	if err := ng.checkFence(s); err != nil {
+		return 0, err
+	}
+	if err := ng.checkWindowLocked(s); err != nil {
+		return 0, err
+	}
+
+	m := Mutation{
+		Type:      MutationAppend,
+		Key:       s.primaryKey,
+		Group:     s.group,
+		Status:    status,
+		Filename:  filename,
+		DependsOn: deps,
+		Time:      time.Now(),
+	}
+	number, err := ng.appendLocked(s, m.Status, m.Filename, m.DependsOn, m.Time)
+	if err != nil {
+		return 0, err
+	}
+	m.Number = number
+
+	return m.Number, ng.publish(m)
+}
+
+// appendLocked appends a record with the given filename to a stream and returns
+// its number. The caller must hold the stream's lock.
+func (ng *NumberGenerator) appendLocked(s stream, status byte, name string, deps []Dependency, at time.Time) (_ uint64, err error) {
+	// Ensure the key directory and the stream's own directory exist
+	if err := ng.ensureKeyDir(s.primaryKey); err != nil {
+		return 0, err
+	}
+	basePath := ng.buildStreamPath(s)
 	baseDir := filepath.Dir(basePath)
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(baseDir, 0755); err != nil {
@@ -170,18 +419,36 @@ func (ng *NumberGenerator) AppendRecord(primaryKey string, status byte) (uint64,
 		}
 	}
 
-	// Work with the file
-	file, err := os.OpenFile(basePath, os.O_RDWR|os.O_CREATE, 0666)
+	// Work with the cached file
+	file, err := ng.ensureFileOpen(s)
 	if err != nil {
 		return 0, err
 	}
-	defer file.Close()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
 
 	header := FileHeader{}
 	if err := binary.Read(file, binary.BigEndian, &header); err != nil && err != io.EOF {
 		return 0, err
 	}
 
+	// Record the dependencies and the global sequence number first, so the record
+	// is never visible without them
+	if err := ng.setDependenciesLocked(s, header.TotalRecords+1, deps); err != nil {
+		return 0, err
+	}
+	seq, err := ng.stampLocked(s, header.TotalRecords+1)
+	if err != nil {
+		return 0, err
+	}
+	counted := false
+	defer func() {
+		if err != nil && !counted {
+			err = errors.Join(err, ng.voidStamp(seq))
+		}
+	}()
+
 	// Increment and update the record count
 	header.TotalRecords++
 	if header.TotalRecords == 1 {
@@ -195,56 +462,85 @@ func (ng *NumberGenerator) AppendRecord(primaryKey string, status byte) (uint64,
 	if err := binary.Write(file, binary.BigEndian, &header); err != nil {
 		return 0, err
 	}
+	counted = true
+	ng.metrics.backlog.set(s, header)
 
-	// Write new record at the end of the file
-	newUUID, err := uuid.NewRandom()
-	if err != nil {
-		return 0, err
-	}
+	// Write the new record into its slot, which is the end of the file unless an
+	// earlier append was interrupted after its header update.
 	filename := [36]byte{}
-	copy(filename[:], newUUID.String())
+	copy(filename[:], name)
 	record := NumberStatusFilename{
 		Number:   header.TotalRecords,
 		Status:   status,
 		Filename: filename,
 	}
 
-	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+	if _, err := file.Seek(headerSize+int64(header.TotalRecords-1)*recordSize, io.SeekStart); err != nil {
 		return 0, err
 	}
 	if err := binary.Write(file, binary.BigEndian, &record); err != nil {
 		return 0, err
 	}
 
+	// Remember when the record was appended
+	if err := ng.setAppendedAt(s, header.TotalRecords, at); err != nil {
+		return 0, err
+	}
+
+	ng.notify(s, Event{Type: EventAppended, Number: header.TotalRecords, Status: status, Watermark: header.LastUpdated, Time: at})
 	return header.TotalRecords, nil
 }
 
 // UpdateStatuses updates the status to 1 for a set of numbers in the binary file associated with the primary key.
 // It also updates the LastUpdated field to be the last number provided in the numbers slice.
 func (ng *NumberGenerator) UpdateStatuses(primaryKey string, numbers []uint64) error {
+	return ng.updateStatuses(context.Background(), stream{primaryKey: primaryKey}, numbers, false)
+}
+
+// UpdateStatusesContext is UpdateStatuses waiting for the key's rate limit until
+// ctx is done instead of failing, see SetRateLimits.
+func (ng *NumberGenerator) UpdateStatusesContext(ctx context.Context, primaryKey string, numbers []uint64) error {
+	return ng.updateStatuses(ctx, stream{primaryKey: primaryKey}, numbers, true)
+}
+
+func (ng *NumberGenerator) updateStatuses(ctx context.Context, s stream, numbers []uint64, wait bool) (err error) {
 	if len(numbers) == 0 {
 		return nil // No updates to perform
 	}
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+	defer ng.metrics.updateLatency.ObserveSince(time.Now())
 
-	// Ensure the file is open before proceeding
-	err := ng.ensureFileOpen(primaryKey)
-	if err != nil {
-		return err // Return any errors encountered during file opening
+	if err := ng.takeTokens(ctx, s.primaryKey, opAdvance, len(numbers), wait); err != nil {
+		return err
 	}
 
-	// Proceed with file updates as before, using the now-guaranteed file from the cache
-	ng.lock.Lock()
-	file := ng.fileCache[primaryKey] // We can directly access the file as ensureFileOpen has already done the error checking
-	ng.lock.Unlock()
+	defer ng.lockMutation(s)(&err)
 
-	lock, exists := ng.locks[primaryKey]
-	if !exists {
-		lock = &sync.Mutex{}
-		ng.locks[primaryKey] = lock
+	m := Mutation{
+		Type:    MutationUpdateStatuses,
+		Key:     s.primaryKey,
+		Group:   s.group,
+		Numbers: numbers,
+		Time:    time.Now(),
+	}
+	if err := ng.updateStatusesLocked(s, m.Numbers, m.Time); err != nil {
+		ng.refundTokens(s.primaryKey, opAdvance, len(numbers))
+		return err
 	}
 
-	lock.Lock()
-	defer lock.Unlock()
+	return ng.publish(m)
+}
+
+// updateStatusesLocked sets the status of the given numbers to 1 and moves the
+// watermark to the last of them. The caller must hold the stream's lock.
+func (ng *NumberGenerator) updateStatusesLocked(s stream, numbers []uint64, at time.Time) error {
+	// Ensure the file is open before proceeding
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err // Return any errors encountered during file opening
+	}
 
 	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
@@ -272,8 +568,18 @@ func (ng *NumberGenerator) UpdateStatuses(primaryKey string, numbers []uint64) e
 		}
 	}
 
+	// Remember when the statuses changed.
+	err = ng.setUpdatedAt(s, numbers, at)
+	if err != nil {
+		return err
+	}
+
 	// Update the LastUpdated field to the last number in the list.
+	previous := header.LastUpdated
 	header.LastUpdated = numbers[len(numbers)-1]
+	if header.LastUpdated < previous {
+		ng.rewinds.Add(1) // Before the watermark moves back, see dependenciesMet
+	}
 
 	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
@@ -283,18 +589,46 @@ func (ng *NumberGenerator) UpdateStatuses(primaryKey string, numbers []uint64) e
 	if err != nil {
 		return err
 	}
+	ng.metrics.backlog.set(s, header)
 
-	return file.Sync() // Ensure the updates are saved to disk
+	err = ng.syncFile(file) // Ensure the updates are saved to disk
+	if err != nil {
+		return err
+	}
+
+	// Records count as done in the global log once the watermark passed them, the
+	// same rule reconcileGlobalLog applies after a restart.
+	if header.LastUpdated > previous {
+		err = ng.markGlobalDoneLocked(s, numberRange(previous+1, header.LastUpdated))
+	} else {
+		err = ng.rewindGlobalLocked(s, numberRange(header.LastUpdated+1, previous))
+	}
+	if err != nil {
+		return err
+	}
+
+	ng.notifyUpdate(s, numbers, previous, header.LastUpdated, at)
+	return nil
 }
 
 // GetStatus retrieves the status for a given number in the binary file associated with the primary key.
 func (ng *NumberGenerator) GetStatus(primaryKey string, number uint64) (byte, error) {
+	return ng.getStatus(stream{primaryKey: primaryKey}, number)
+}
+
+func (ng *NumberGenerator) getStatus(s stream, number uint64) (byte, error) {
+	defer ng.lockStream(s)()
+
 	// Ensure the file is open before proceeding
-	err := ng.ensureFileOpen(primaryKey)
+	file, err := ng.ensureFileOpen(s)
 	if err != nil {
 		return 0, err // Return any errors encountered during file opening
 	}
-	file := ng.fileCache[primaryKey]
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
 
 	header := FileHeader{}
 	err = binary.Read(file, binary.BigEndian, &header)
@@ -322,27 +656,42 @@ func (ng *NumberGenerator) GetStatus(primaryKey string, number uint64) (byte, er
 	return record.Status, nil
 }
 
-// CloseAllFiles closes all open file descriptors in the file cache.
-func (ng *NumberGenerator) CloseAllFiles() {
+// CloseAllFiles closes all open file descriptors in the file cache. Every handle
+// is closed even if some fail; the failures are logged and returned together.
+func (ng *NumberGenerator) CloseAllFiles() error {
 	ng.lock.Lock()
 	defer ng.lock.Unlock()
-	for _, file := range ng.fileCache {
-		err := file.Close()
-		if err != nil {
-			// Log or handle the error as appropriate for your application
+
+	var errs []error
+	for path, elem := range ng.fileCache {
+		if err := elem.Value.(*cachedFile).file.Close(); err != nil {
+			ng.logger.Error("closing file", "path", path, "error", err)
+			errs = append(errs, err)
 		}
 	}
-	ng.fileCache = make(map[string]*os.File) // Reset the file cache after closing files
+	ng.fileCache = make(map[string]*list.Element) // Reset the file cache after closing files
+	ng.lru.Init()
+	return errors.Join(errs...)
 }
 
 // GetFilename retrieves the filename for a given number in the binary file associated with the primary key.
 func (ng *NumberGenerator) GetFilename(primaryKey string, number uint64) (string, error) {
+	return ng.getFilename(stream{primaryKey: primaryKey}, number)
+}
+
+func (ng *NumberGenerator) getFilename(s stream, number uint64) (string, error) {
+	defer ng.lockStream(s)()
+
 	// Ensure the file is open before proceeding
-	err := ng.ensureFileOpen(primaryKey)
+	file, err := ng.ensureFileOpen(s)
 	if err != nil {
 		return "", err // Return any errors encountered during file opening
 	}
-	file := ng.fileCache[primaryKey]
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
 
 	// Read the header to ensure the file structure is correct and to know if the requested record exists.
 	header := FileHeader{}
@@ -378,12 +727,17 @@ func (ng *NumberGenerator) GetFilename(primaryKey string, number uint64) (string
 
 // GetLastUpdateNumber retrieves the last updated record number from the binary file associated with the primary key.
 func (ng *NumberGenerator) GetLastUpdateNumber(primaryKey string) (uint64, error) {
+	return ng.getLastUpdateNumber(stream{primaryKey: primaryKey})
+}
+
+func (ng *NumberGenerator) getLastUpdateNumber(s stream) (uint64, error) {
+	defer ng.lockStream(s)()
+
 	// Ensure the file is open before proceeding
-	err := ng.ensureFileOpen(primaryKey)
+	file, err := ng.ensureFileOpen(s)
 	if err != nil {
 		return 0, err // Return any errors encountered during file opening
 	}
-	file := ng.fileCache[primaryKey]
 
 	// Position the file pointer at the beginning of the file to read the header
 	_, err = file.Seek(0, io.SeekStart)
@@ -400,32 +754,27 @@ func (ng *NumberGenerator) GetLastUpdateNumber(primaryKey string) (uint64, error
 	return header.LastUpdated, nil
 }
 
-// UpdateStatusIfMatch uses the existing UpdateStatuses function to update the status of the record associated with 'number' if 'number - 1' is equal to the last updated record number.
+// UpdateStatusIfMatch updates the status of the record associated with 'number' if 'number - 1' is equal to the last updated record number.
+// The comparison and the update are one step under the key's lock, see CompareAndAdvance.
+// It returns false both for a record that is early and for one that is already done; TryAdvance tells them apart.
+// A record appended with AppendRecordAfter additionally does not match until all of its dependencies are met.
 func (ng *NumberGenerator) UpdateStatusIfMatch(primaryKey string, number uint64) (bool, error) {
-	// Ensure the file is open before proceeding
-	if err := ng.ensureFileOpen(primaryKey); err != nil {
-		return false, err // Return any errors encountered during file opening
-	}
-
-	// Get the last update number
-	lastUpdated, err := ng.GetLastUpdateNumber(primaryKey)
-	if err != nil {
-		return false, err // Return any errors encountered during getting the last updated number
-	}
-
-	// Check if 'number - 1' equals the last updated number
-	if number-1 == lastUpdated {
-		// If so, prepare the number for update
-		numbers := []uint64{number}
+	return ng.updateStatusIfMatch(context.Background(), stream{primaryKey: primaryKey}, number, false)
+}
 
-		// Use the existing UpdateStatuses function to update the status
-		if err := ng.UpdateStatuses(primaryKey, numbers); err != nil {
-			return false, err // Return any errors encountered during updating statuses
-		}
+// UpdateStatusIfMatchContext is UpdateStatusIfMatch traced as part of the trace in
+// ctx. It waits for the key's rate limit until ctx is done instead of failing.
+func (ng *NumberGenerator) UpdateStatusIfMatchContext(ctx context.Context, primaryKey string, number uint64) (bool, error) {
+	return ng.updateStatusIfMatch(ctx, stream{primaryKey: primaryKey}, number, true)
+}
 
-		return true, nil // Status updated successfully
-	}
+func (ng *NumberGenerator) updateStatusIfMatch(ctx context.Context, s stream, number uint64, wait bool) (matched bool, err error) {
+	ctx, span := ng.startSpan(ctx, "queueguard.UpdateStatusIfMatch", s, Attribute{"queueguard.number", number})
+	defer func() {
+		span.SetAttributes(Attribute{"queueguard.matched", matched})
+		endSpan(span, err)
+	}()
 
-	// 'number - 1' does not equal the last updated number, no update performed
-	return false, nil
+	result, err := ng.tryAdvance(ctx, s, "", number, wait)
+	return result == Advanced, err
 }
@@ -5,11 +5,27 @@
 package numbergenerator
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"queueguard/metrics"
+	vmoformat "queueguard/vmofile"
 )
 
 func BenchmarkAppendRecord(b *testing.B) {
@@ -23,7 +39,10 @@ func BenchmarkAppendRecord(b *testing.B) {
 	b.Log("Temporary directory:", dir)
 
 	// Initialize the NumberGenerator with the temp directory
-	gen := NewNumberGenerator(dir)
+	gen, err := NewNumberGenerator(dir)
+	if err != nil {
+		b.Fatalf("Could not create the NumberGenerator: %v", err)
+	}
 
 	// Pre-create a primary key directory to simulate a typical usage scenario
 	primaryKey := "test"
@@ -50,7 +69,7 @@ func BenchmarkAppendRecord(b *testing.B) {
 func TestReadRecords(t *testing.T) {
 	// Setup
 	basePath := "test_data"
-	ng := NewNumberGenerator(basePath)
+	ng := newGenerator(t, basePath)
 	defer os.RemoveAll(basePath) // Clean up after the test
 
 	// Prepopulate with data
@@ -78,7 +97,7 @@ func TestReadRecords(t *testing.T) {
 func TestUpdateRecords(t *testing.T) {
 	// Setup
 	basePath := "test_data"
-	ng := NewNumberGenerator(basePath)
+	ng := newGenerator(t, basePath)
 	defer os.RemoveAll(basePath) // Clean up after the test
 
 	// Prepopulate with data
@@ -111,7 +130,7 @@ func TestUpdateRecords(t *testing.T) {
 func BenchmarkUpdateRecords(b *testing.B) {
 	// Setup
 	basePath := "bench_data"
-	ng := NewNumberGenerator(basePath)
+	ng := newGenerator(b, basePath)
 	defer os.RemoveAll(basePath) // Clean up after the benchmark
 
 	// Prepopulate with data
@@ -138,3 +157,1709 @@ func BenchmarkUpdateRecords(b *testing.B) {
 		}
 	}
 }
+
+// newGenerator opens a NumberGenerator and fails the test if that is not possible.
+func newGenerator(tb testing.TB, basePath string, opts ...Option) *NumberGenerator {
+	tb.Helper()
+	ng, err := NewNumberGenerator(basePath, opts...)
+	if err != nil {
+		tb.Fatalf("NewNumberGenerator failed: %v", err)
+	}
+	return ng
+}
+
+func TestGroupsAreIndependent(t *testing.T) {
+	dir := t.TempDir()
+	ng := newGenerator(t, dir)
+	defer ng.Close()
+
+	orders, err := ng.Group("tenant", "orders")
+	if err != nil {
+		t.Fatalf("Group failed: %v", err)
+	}
+	invoices, err := ng.Group("tenant", "invoices")
+	if err != nil {
+		t.Fatalf("Group failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := orders.AppendRecord(0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	number, err := invoices.AppendRecord(0)
+	if err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+	if number != 1 {
+		t.Errorf("expected the first invoice to be number 1, got %d", number)
+	}
+
+	// Advancing one group must not move the other one.
+	if ok, err := orders.UpdateStatusIfMatch(1); !ok || err != nil {
+		t.Fatalf("UpdateStatusIfMatch(1) = %v, %v", ok, err)
+	}
+	if last, _ := invoices.GetLastUpdateNumber(); last != 0 {
+		t.Errorf("expected invoices watermark 0, got %d", last)
+	}
+	if last, _ := orders.GetLastNumber(); last != 3 {
+		t.Errorf("expected 3 orders, got %d", last)
+	}
+
+	groups, err := ng.Groups("tenant")
+	if err != nil {
+		t.Fatalf("Groups failed: %v", err)
+	}
+	if len(groups) != 2 || groups[0] != "invoices" || groups[1] != "orders" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	if _, err := ng.Group("tenant", "../escape"); err == nil {
+		t.Error("expected an invalid group ID to be rejected")
+	}
+}
+
+func TestKeysAreEncodedInsideBasePath(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "data")
+	ng := newGenerator(t, base)
+	defer ng.Close()
+
+	for _, key := range []string{"../../etc", "a/b", "a"} {
+		if _, err := ng.AppendRecord(key, 0); err != nil {
+			t.Fatalf("AppendRecord(%q) failed: %v", key, err)
+		}
+		if last, err := ng.GetLastNumber(key); err != nil || last != 1 {
+			t.Errorf("GetLastNumber(%q) = %d, %v", key, last, err)
+		}
+	}
+
+	// Nothing may be written outside of the base directory.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the base directory in %s, found %d entries", dir, len(entries))
+	}
+
+	if _, err := ng.AppendRecord("", 0); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for an empty key, got %v", err)
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	base := t.TempDir()
+
+	// Write files in the old basePath/primaryKey/data.bin layout, including a key
+	// with a separator that used to produce nested directories.
+	writeLegacy := func(key string, header FileHeader) {
+		path := filepath.Join(base, filepath.FromSlash(key), "data.bin")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := binary.Write(file, binary.BigEndian, &header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLegacy("orders", FileHeader{TotalRecords: 0, LastUpdated: 0})
+	writeLegacy("tenant/orders", FileHeader{TotalRecords: 0, LastUpdated: 0})
+
+	// A migration interrupted after writing the key file is completed.
+	writeLegacy("payments", FileHeader{TotalRecords: 0, LastUpdated: 0})
+	if err := writeKeyFile(filepath.Join(base, "payments"), "payments"); err != nil {
+		t.Fatal(err)
+	}
+
+	ng := newGenerator(t, base)
+	defer ng.Close()
+
+	for _, key := range []string{"orders", "tenant/orders", "payments"} {
+		if _, err := os.Stat(ng.buildFilePath(key)); err != nil {
+			t.Errorf("key %q was not migrated: %v", key, err)
+		}
+		if _, err := ng.GetLastNumber(key); err != nil {
+			t.Errorf("GetLastNumber(%q) failed after migration: %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, "tenant")); !os.IsNotExist(err) {
+		t.Errorf("expected the empty legacy parent directory to be removed, got %v", err)
+	}
+}
+
+func TestFanOutRelocatesKeys(t *testing.T) {
+	base := t.TempDir()
+
+	ng := newGenerator(t, base)
+	for _, key := range []string{"orders", "customers"} {
+		if _, err := ng.AppendRecord(key, 0); err != nil {
+			t.Fatalf("AppendRecord(%q) failed: %v", key, err)
+		}
+	}
+	ng.Close()
+
+	ng = newGenerator(t, base, WithFanOut(2))
+	defer ng.Close()
+
+	for _, key := range []string{"orders", "customers"} {
+		path := ng.buildFilePath(key)
+		rel, _ := filepath.Rel(base, path)
+		if strings.Count(filepath.ToSlash(rel), "/") != 3 {
+			t.Errorf("expected %s to be nested two levels deep", rel)
+		}
+		if last, err := ng.GetLastNumber(key); err != nil || last != 1 {
+			t.Errorf("GetLastNumber(%q) = %d, %v after relocation", key, last, err)
+		}
+	}
+
+	layout, err := os.ReadFile(filepath.Join(base, layoutFileName))
+	if err != nil || string(layout) != "fanout=2\n" {
+		t.Errorf("unexpected layout file %q: %v", layout, err)
+	}
+}
+
+func TestMaxOpenFilesEvictsIdleHandles(t *testing.T) {
+	ng := newGenerator(t, t.TempDir(), WithMaxOpenFiles(2))
+	defer ng.Close()
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		if _, err := ng.AppendRecord(key, 0); err != nil {
+			t.Fatalf("AppendRecord(%q) failed: %v", key, err)
+		}
+	}
+
+	// Every append uses the data file and the times file of its key.
+	stats := ng.CacheStats()
+	if stats.Open != 2 {
+		t.Errorf("expected 2 open handles, got %d", stats.Open)
+	}
+	if stats.Evictions != 6 {
+		t.Errorf("expected 6 evictions, got %d", stats.Evictions)
+	}
+
+	// Evicted keys must be reopened transparently.
+	for _, key := range keys {
+		if last, err := ng.GetLastNumber(key); err != nil || last != 1 {
+			t.Errorf("GetLastNumber(%q) = %d, %v", key, last, err)
+		}
+	}
+	if _, err := ng.GetLastNumber("d"); err != nil {
+		t.Fatalf("GetLastNumber failed: %v", err)
+	}
+	if stats := ng.CacheStats(); stats.Open != 2 || stats.Hits != 1 || stats.Misses != 12 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
+
+func TestBasePathIsLockedAgainstOtherWriters(t *testing.T) {
+	base := t.TempDir()
+	ng := newGenerator(t, base)
+
+	open := func(opts ...Option) error {
+		other, err := NewNumberGenerator(base, opts...)
+		if err != nil {
+			return err
+		}
+		return other.Close()
+	}
+
+	if err := open(); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a second writer to fail with ErrLocked, got %v", err)
+	}
+	if err := open(WithReadOnly()); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a reader to fail with ErrLocked while a writer runs, got %v", err)
+	}
+
+	if _, err := ng.AppendRecord("orders", 0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+	ng.Close()
+
+	// Any number of readers may share the base path once the writer is gone.
+	reader := newGenerator(t, base, WithReadOnly())
+	defer reader.Close()
+	if err := open(WithReadOnly()); err != nil {
+		t.Errorf("expected readers to share the lock, got %v", err)
+	}
+	if err := open(); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a writer to fail with ErrLocked while a reader runs, got %v", err)
+	}
+
+	if last, err := reader.GetLastNumber("orders"); err != nil || last != 1 {
+		t.Errorf("GetLastNumber = %d, %v", last, err)
+	}
+	if _, err := reader.AppendRecord("orders", 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	// Without a lock file there is no writer to exclude, e.g. in a copy of the
+	// data, and a reader does not create one.
+	reader.Close()
+	if err := os.Remove(filepath.Join(base, lockFileName)); err != nil {
+		t.Fatalf("removing the lock file failed: %v", err)
+	}
+	if err := open(WithReadOnly()); err != nil {
+		t.Errorf("expected a reader to open a base path without a lock file, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, lockFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected no lock file after a read-only open, got %v", err)
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	segments, err := vmoformat.NewVMOFiles(filepath.Join(t.TempDir(), "segments"))
+	if err != nil {
+		t.Fatalf("NewVMOFiles failed: %v", err)
+	}
+	segments.AddRecord([16]byte{1})
+
+	ng := newGenerator(t, t.TempDir(), WithSegments(segments))
+	defer ng.Close()
+	orders, _ := ng.Group("tenant", "orders")
+	for i := 0; i < 100; i++ {
+		if _, err := ng.AppendRecord("tenant", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+		if _, err := orders.AppendRecord(0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	if err := ng.UpdateStatuses("tenant", []uint64{1, 2}); err != nil {
+		t.Fatalf("UpdateStatuses failed: %v", err)
+	}
+
+	// Keep appending while the snapshot is taken.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ng.AppendRecord("busy", 0)
+		}
+	}()
+	var archive bytes.Buffer
+	if err := ng.Snapshot(&archive); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	<-done
+	segmentInfo, err := os.Stat(segments.Files[0].FilePath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	target := newGenerator(t, t.TempDir(), WithFanOut(1), WithSegments(segments))
+	defer target.Close()
+	if _, err := target.AppendRecord("stale", 0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+
+	// A restore that cannot move a key into place leaves the current keys in place.
+	blocker := filepath.Join(target.basePath, encodeKey("tenant")[:2])
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := target.Restore(bytes.NewReader(archive.Bytes())); err == nil {
+		t.Fatal("expected Restore to fail while a key cannot be moved into place")
+	}
+	if last, err := target.GetLastNumber("stale"); err != nil || last != 1 {
+		t.Errorf("GetLastNumber after a failed restore = %d, %v", last, err)
+	}
+	if _, err := segments.GetTotalCount([16]byte{1}); err != nil {
+		t.Errorf("segment record missing after a failed restore: %v", err)
+	}
+	os.Remove(blocker)
+
+	if err := target.Restore(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if last, err := target.GetLastNumber("tenant"); err != nil || last != 100 {
+		t.Errorf("GetLastNumber = %d, %v", last, err)
+	}
+	if last, err := target.GetLastUpdateNumber("tenant"); err != nil || last != 2 {
+		t.Errorf("GetLastUpdateNumber = %d, %v", last, err)
+	}
+	restoredOrders, _ := target.Group("tenant", "orders")
+	if last, err := restoredOrders.GetLastNumber(); err != nil || last != 100 {
+		t.Errorf("group GetLastNumber = %d, %v", last, err)
+	}
+	if _, err := os.Stat(target.buildFilePath("stale")); !os.IsNotExist(err) {
+		t.Errorf("expected keys missing from the snapshot to be removed, got %v", err)
+	}
+
+	// Every archived key must be self-consistent even though appends continued.
+	busy, err := target.GetLastNumber("busy")
+	if err == nil {
+		info, err := os.Stat(target.buildFilePath("busy"))
+		if err != nil || info.Size() != headerSize+int64(busy)*recordSize {
+			t.Errorf("busy key has %d records but its file is %d bytes", busy, info.Size())
+		}
+	}
+
+	if info, err := os.Stat(segments.Files[0].FilePath); err != nil || info.Size() != segmentInfo.Size() {
+		t.Errorf("restored segment = %v, %v, want %d bytes", info, err, segmentInfo.Size())
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source := newGenerator(t, t.TempDir())
+	defer source.Close()
+
+	for i := 0; i < 5; i++ {
+		source.AppendRecord("orders", 0)
+	}
+	source.UpdateStatuses("orders", []uint64{1, 2})
+	refunds, _ := source.Group("orders", "refunds")
+	refunds.AppendRecord(0)
+
+	var exported bytes.Buffer
+	if err := source.Export(&exported); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if lines := strings.Count(exported.String(), "\n"); lines != 8 {
+		t.Errorf("expected 2 headers and 6 records, got %d lines:\n%s", lines, exported.String())
+	}
+	if !strings.Contains(exported.String(), `"updated_at"`) {
+		t.Errorf("expected status change times in the export:\n%s", exported.String())
+	}
+
+	target := newGenerator(t, t.TempDir())
+	defer target.Close()
+	replica := newGenerator(t, t.TempDir())
+	defer replica.Close()
+	target.AddMutationHook(replica.ApplyMutation)
+	target.AppendRecord("orders", 0) // Replaced by the import
+	billing, _ := target.Consumer("orders", "billing")
+	billing.UpdateStatuses([]uint64{1})
+	events, err := target.Watch(context.Background(), "orders")
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := target.Import(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	// Consumer groups start over, subscribers and hooks learn about the import.
+	if watermark, err := billing.GetLastUpdateNumber(); err != nil || watermark != 0 {
+		t.Errorf("consumer watermark after import = %d, %v", watermark, err)
+	}
+	var imported bool
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventImported {
+			imported = e.Number == 5 && e.Watermark == 2
+		}
+	}
+	if !imported {
+		t.Error("expected an EventImported with 5 records and watermark 2")
+	}
+	var replicated bytes.Buffer
+	if err := replica.Export(&replicated); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if replicated.String() != exported.String() {
+		t.Errorf("replica differs after import:\n%s\nvs\n%s", replicated.String(), exported.String())
+	}
+
+	var reexported bytes.Buffer
+	if err := target.Export(&reexported, "orders"); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if reexported.String() != exported.String() {
+		t.Errorf("round trip changed the state:\n%s\nvs\n%s", exported.String(), reexported.String())
+	}
+
+	// Appending continues after the imported records.
+	if number, err := target.AppendRecord("orders", 0); err != nil || number != 6 {
+		t.Errorf("AppendRecord after import = %d, %v", number, err)
+	}
+
+	truncated := `{"type":"header","key":"broken","total_records":2,"last_updated":0}
+{"type":"record","key":"broken","number":1,"status":0,"filename":"x"}
+`
+	if err := target.Import(strings.NewReader(truncated)); err == nil {
+		t.Error("expected an incomplete stream to be rejected")
+	}
+	if _, err := os.Stat(target.buildFilePath("broken")); !os.IsNotExist(err) {
+		t.Errorf("expected the incomplete stream not to be written, got %v", err)
+	}
+}
+
+func TestGapsReportPendingRecords(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	if report, err := ng.Gaps("orders"); err != nil || report.Blocking != 0 || len(report.Pending) != 0 {
+		t.Errorf("Gaps of an empty key = %+v, %v", report, err)
+	}
+
+	for i := 0; i < 6; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	ng.UpdateStatuses("orders", []uint64{1, 2})
+	ng.UpdateStatuses("orders", []uint64{5, 2}) // 5 is done out of order, the watermark stays at 2
+
+	report, err := ng.Gaps("orders")
+	if err != nil {
+		t.Fatalf("Gaps failed: %v", err)
+	}
+	if report.TotalRecords != 6 || report.Watermark != 2 || report.Blocking != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	var pending []uint64
+	for _, gap := range report.Pending {
+		pending = append(pending, gap.Number)
+		if gap.AppendedAt.IsZero() || gap.Waiting <= 0 {
+			t.Errorf("expected the wait time of %d, got %+v", gap.Number, gap)
+		}
+	}
+	if fmt.Sprint(pending) != "[3 4 6]" {
+		t.Errorf("pending numbers = %v, want [3 4 6]", pending)
+	}
+
+	ng.UpdateStatuses("orders", []uint64{3, 4, 6})
+	if report, err := ng.Gaps("orders"); err != nil || report.Blocking != 0 || len(report.Pending) != 0 {
+		t.Errorf("Gaps after catching up = %+v, %v", report, err)
+	}
+}
+
+func TestStallDetectorAlertsSinks(t *testing.T) {
+	var alerts []StallAlert
+	var posted []StallAlert
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert StallAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		posted = append(posted, alert)
+	}))
+	defer webhook.Close()
+
+	// The background check never runs during the test, checks are triggered below.
+	ng := newGenerator(t, t.TempDir(), WithStallDetector(StallDetectorConfig{
+		Threshold: time.Minute,
+		Interval:  time.Hour,
+		Sinks: []AlertSink{
+			AlertFunc(func(alert StallAlert) error { alerts = append(alerts, alert); return nil }),
+			WebhookSink(webhook.URL, nil),
+		},
+	}))
+	defer ng.Close()
+
+	for i := 0; i < 3; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	ng.UpdateStatuses("orders", []uint64{1})
+	ng.AppendRecord("done", 0)
+	ng.UpdateStatuses("done", []uint64{1})
+
+	detector := ng.stallDetector
+	detector.check(time.Now())
+	if len(alerts) != 0 {
+		t.Fatalf("expected no alerts before the threshold, got %+v", alerts)
+	}
+	later := time.Now().Add(2 * time.Minute)
+	detector.check(later)
+	detector.check(later) // Reported only once
+	if len(alerts) != 1 || alerts[0].PrimaryKey != "orders" || alerts[0].Blocking != 2 || alerts[0].Resolved {
+		t.Fatalf("unexpected alerts %+v", alerts)
+	}
+	if alerts[0].StalledFor < 2*time.Minute {
+		t.Errorf("StalledFor = %s, want at least 2m", alerts[0].StalledFor)
+	}
+
+	ng.UpdateStatuses("orders", []uint64{2, 3})
+	detector.check(later)
+	if len(alerts) != 2 || !alerts[1].Resolved || alerts[1].Watermark != 3 {
+		t.Errorf("expected a resolved alert, got %+v", alerts)
+	}
+	if len(posted) != 2 || posted[0].Blocking != 2 || !posted[1].Resolved {
+		t.Errorf("unexpected webhook alerts %+v", posted)
+	}
+}
+
+// drainEvents reads the events currently buffered in ch.
+func drainEvents(ch <-chan Event) []string {
+	var events []string
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return append(events, "closed")
+			}
+			events = append(events, fmt.Sprintf("%s:%d:%d", e.Type, e.Number, e.Watermark))
+		default:
+			return events
+		}
+	}
+}
+
+func TestWatchStreamsChanges(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ng.Watch(ctx, "orders")
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	ng.AppendRecord("orders", 0)
+	ng.AppendRecord("orders", 0)
+	ng.AppendRecord("other", 0)
+	ng.UpdateStatuses("orders", []uint64{1})
+	ng.UpdateStatusIfMatch("orders", 2)
+
+	want := "[appended:1:0 appended:2:0 status_changed:1:1 watermark_advanced:0:1 status_changed:2:2 watermark_advanced:0:2]"
+	if got := fmt.Sprint(drainEvents(events)); got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range events {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+
+	// A subscriber resuming from 2 gets the stored state from there on.
+	events, err = ng.Watch(context.Background(), "orders", WatchFrom(2))
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	want = "[appended:2:2 status_changed:2:2 watermark_advanced:0:2]"
+	if got := fmt.Sprint(drainEvents(events)); got != want {
+		t.Errorf("replayed events = %s, want %s", got, want)
+	}
+}
+
+func TestWatchDropsSlowSubscribers(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	events, err := ng.Watch(context.Background(), "orders", WatchBuffer(3))
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+
+	want := "[appended:1:0 appended:2:0 lagged:3:0 closed]"
+	if got := fmt.Sprint(drainEvents(events)); got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+
+	// Resuming from the lagged number continues where the subscriber fell behind.
+	events, _ = ng.Watch(context.Background(), "orders", WatchFrom(3), WatchBuffer(16))
+	want = "[appended:3:0 appended:4:0 appended:5:0]"
+	if got := fmt.Sprint(drainEvents(events)); got != want {
+		t.Errorf("events after resuming = %s, want %s", got, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	base := t.TempDir()
+	reg := metrics.NewRegistry()
+	ng := newGenerator(t, base, WithMetrics(reg))
+
+	for i := 0; i < 4; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	ng.UpdateStatusIfMatch("orders", 1)
+	ng.UpdateStatusIfMatch("orders", 3)
+	refunds, _ := ng.Group("orders", "refunds")
+	refunds.AppendRecord(0)
+
+	var out strings.Builder
+	if err := reg.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	for _, line := range []string{
+		`queueguard_backlog{key="orders",group=""} 3`,
+		`queueguard_backlog{key="orders",group="refunds"} 1`,
+		`queueguard_append_duration_seconds_count 5`,
+		`queueguard_update_duration_seconds_count 1`,
+		`queueguard_fsync_duration_seconds_count 1`,
+		`queueguard_update_if_match_total{result="hit"} 1`,
+		`queueguard_update_if_match_total{result="miss"} 1`,
+		`queueguard_open_files 4`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+
+	// The backlog follows the headers as they are written, and streams written
+	// before the generator was opened are read on the first scrape.
+	backlog := func(reg *metrics.Registry) string {
+		var out strings.Builder
+		if err := reg.WritePrometheus(&out); err != nil {
+			t.Fatalf("WritePrometheus failed: %v", err)
+		}
+		var lines []string
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "queueguard_backlog{") {
+				lines = append(lines, line)
+			}
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, " ")
+	}
+	ng.UpdateStatuses("orders", []uint64{2, 3, 4})
+	want := `queueguard_backlog{key="orders",group=""} 0 queueguard_backlog{key="orders",group="refunds"} 1`
+	if got := backlog(reg); got != want {
+		t.Errorf("backlog after UpdateStatuses = %s, want %s", got, want)
+	}
+	ng.Close()
+
+	reg = metrics.NewRegistry()
+	ng = newGenerator(t, base, WithMetrics(reg))
+	defer ng.Close()
+	if got := backlog(reg); got != want {
+		t.Errorf("backlog after reopening = %s, want %s", got, want)
+	}
+}
+
+// recordingTracer keeps the names and attributes of ended spans.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type recordingSpan struct {
+	t     *recordingTracer
+	name  string
+	attrs []Attribute
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, &recordingSpan{t: t, name: name, attrs: attrs}
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) { s.attrs = append(s.attrs, attrs...) }
+func (s *recordingSpan) RecordError(err error)            { s.SetAttributes(Attribute{"error", err.Error()}) }
+
+func (s *recordingSpan) End() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.spans = append(s.t.spans, fmt.Sprint(s.name, s.attrs))
+}
+
+func TestTracingAndWaitForTurn(t *testing.T) {
+	tracer := &recordingTracer{}
+	ng := newGenerator(t, t.TempDir(), WithTracer(tracer))
+	defer ng.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		ng.AppendRecordContext(ctx, "orders", 0)
+	}
+
+	// Number 3 waits until 1 and 2 are done.
+	waited := make(chan error, 1)
+	go func() {
+		if err := ng.WaitForTurn(ctx, "orders", 3); err != nil {
+			waited <- err
+			return
+		}
+		_, err := ng.UpdateStatusIfMatchContext(ctx, "orders", 3)
+		waited <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-waited:
+		t.Fatalf("WaitForTurn returned before its turn: %v", err)
+	default:
+	}
+	ng.UpdateStatusIfMatchContext(ctx, "orders", 1)
+	ng.UpdateStatusIfMatchContext(ctx, "orders", 2)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("waiting for the turn failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForTurn did not return after its turn came")
+	}
+	if last, _ := ng.GetLastUpdateNumber("orders"); last != 3 {
+		t.Errorf("watermark = %d, want 3", last)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := ng.WaitForTurn(timeout, "orders", 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForTurn past the deadline = %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	spans := strings.Join(tracer.spans, "\n")
+	for _, want := range []string{
+		"queueguard.AppendRecord[{queueguard.key orders} {queueguard.number 3}]",
+		"queueguard.WaitForTurn[{queueguard.number 3} {queueguard.key orders} {queueguard.watermark 2}]",
+		"queueguard.UpdateStatusIfMatch[{queueguard.number 3} {queueguard.key orders} {queueguard.matched true}]",
+		"queueguard.WaitForTurn[{queueguard.number 10} {queueguard.key orders} {queueguard.watermark 3} {error context deadline exceeded}]",
+	} {
+		if !strings.Contains(spans, want) {
+			t.Errorf("missing span %s in:\n%s", want, spans)
+		}
+	}
+
+	// A nil tracer disables tracing.
+	untraced := newGenerator(t, t.TempDir(), WithTracer(nil))
+	defer untraced.Close()
+	if _, err := untraced.AppendRecordContext(ctx, "orders", 0); err != nil {
+		t.Errorf("AppendRecordContext without a tracer failed: %v", err)
+	}
+}
+
+func TestInvalidSetupReturnsErrors(t *testing.T) {
+	base := t.TempDir()
+	if _, err := NewNumberGenerator(base, WithFanOut(maxFanOut+1)); err == nil {
+		t.Error("expected an invalid fan-out to be rejected")
+	}
+	if _, err := NewNumberGenerator(filepath.Join(base, "missing"), WithReadOnly()); err == nil {
+		t.Error("expected a missing read-only base path to be rejected")
+	}
+
+	// Close errors are logged and returned instead of being dropped.
+	var logged bytes.Buffer
+	ng := newGenerator(t, base, WithLogger(slog.New(slog.NewTextHandler(&logged, nil))))
+	ng.AppendRecord("orders", 0)
+	for _, elem := range ng.fileCache {
+		elem.Value.(*cachedFile).file.Close() // Closing again fails
+	}
+	if err := ng.Close(); err == nil {
+		t.Error("expected Close to report the failed file closes")
+	}
+	if !strings.Contains(logged.String(), "closing file") {
+		t.Errorf("expected the close errors to be logged, got %q", logged.String())
+	}
+
+	segments, err := vmoformat.NewVMOFiles(filepath.Join(t.TempDir(), "segments"))
+	if err != nil {
+		t.Fatalf("NewVMOFiles failed: %v", err)
+	}
+	segments.Files[0].File.Close()
+	if err := segments.AddRecord([16]byte{1}); err == nil {
+		t.Error("expected AddRecord on a closed segment to fail")
+	}
+	if total := segments.GetTotalRecords(); total != 0 {
+		t.Errorf("GetTotalRecords after a failed AddRecord = %d, want 0", total)
+	}
+}
+
+func TestWindowHoldsBackProducers(t *testing.T) {
+	ng := newGenerator(t, t.TempDir(), WithWindow(2))
+	defer ng.Close()
+
+	ng.AppendRecord("orders", 0)
+	ng.AppendRecord("orders", 0)
+	_, err := ng.AppendRecord("orders", 0)
+	var full *WindowFullError
+	if !errors.As(err, &full) || !errors.Is(err, ErrWindowFull) || full.Outstanding != 2 || full.Window != 2 {
+		t.Fatalf("expected a full window, got %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := ng.AppendRecordContext(timeout, "orders", 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AppendRecordContext past the deadline = %v", err)
+	}
+
+	appended := make(chan uint64, 1)
+	go func() {
+		number, err := ng.AppendRecordContext(context.Background(), "orders", 0)
+		if err != nil {
+			t.Errorf("AppendRecordContext failed: %v", err)
+		}
+		appended <- number
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case number := <-appended:
+		t.Fatalf("AppendRecordContext appended %d into a full window", number)
+	default:
+	}
+	ng.UpdateStatusIfMatch("orders", 1)
+	select {
+	case number := <-appended:
+		if number != 3 {
+			t.Errorf("AppendRecordContext = %d, want 3", number)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AppendRecordContext did not resume once the window had room")
+	}
+
+	// A per-key override replaces the default window.
+	if err := ng.SetKeyWindow("orders", 5); err != nil {
+		t.Fatalf("SetKeyWindow failed: %v", err)
+	}
+	if _, err := ng.AppendRecord("orders", 0); err != nil {
+		t.Errorf("AppendRecord within the larger window failed: %v", err)
+	}
+	ng.SetKeyWindow("orders", 0)
+	if window := ng.KeyWindow("orders"); window != 2 {
+		t.Errorf("KeyWindow after removing the override = %d, want 2", window)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	if err := ng.SetRateLimits("tenant-a/*", RateLimits{Append: RateLimit{Rate: 1, Burst: 2}, Advance: RateLimit{Rate: 100, Burst: 1}}); err != nil {
+		t.Fatalf("SetRateLimits failed: %v", err)
+	}
+	ng.SetRateLimits("tenant-a/vip", RateLimits{Append: RateLimit{Rate: 1000}})
+
+	// The prefix shares one bucket between the tenant's keys.
+	ng.AppendRecord("tenant-a/orders", 0)
+	ng.AppendRecord("tenant-a/refunds", 0)
+	_, err := ng.AppendRecord("tenant-a/orders", 0)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrRateLimited) || limited.Selector != "tenant-a/*" || limited.RetryAfter <= 0 {
+		t.Fatalf("expected the tenant to be rate limited, got %v", err)
+	}
+	if _, err := ng.AppendRecord("tenant-a/vip", 0); err != nil {
+		t.Errorf("the exact key should use its own limit, got %v", err)
+	}
+	if _, err := ng.AppendRecord("tenant-b/orders", 0); err != nil {
+		t.Errorf("other tenants should not be limited, got %v", err)
+	}
+
+	// The first status update empties the advance bucket; the Context variant waits
+	// for it to refill.
+	ng.UpdateStatuses("tenant-a/orders", []uint64{1})
+	if _, err := ng.UpdateStatusIfMatch("tenant-a/refunds", 1); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected the status update to be rate limited, got %v", err)
+	}
+	if matched, err := ng.UpdateStatusIfMatchContext(context.Background(), "tenant-a/refunds", 1); err != nil || !matched {
+		t.Errorf("UpdateStatusIfMatchContext = %v, %v", matched, err)
+	}
+
+	// Appends rejected by a full window give their token back.
+	ng.SetRateLimits("tenant-c/*", RateLimits{Append: RateLimit{Rate: 0.001, Burst: 2}})
+	ng.SetKeyWindow("tenant-c/orders", 1)
+	ng.AppendRecord("tenant-c/orders", 0)
+	if _, err := ng.AppendRecord("tenant-c/orders", 0); !errors.Is(err, ErrWindowFull) {
+		t.Fatalf("expected the window to be full, got %v", err)
+	}
+	ng.UpdateStatuses("tenant-c/orders", []uint64{1})
+	if _, err := ng.AppendRecord("tenant-c/orders", 0); err != nil {
+		t.Errorf("a rejected append used up the rate limit: %v", err)
+	}
+
+	// Limits are reported by Describe and can be lifted at runtime.
+	desc, err := ng.Describe("tenant-a/orders")
+	if err != nil {
+		t.Fatalf("Describe failed: %v", err)
+	}
+	if desc.TotalRecords != 1 || desc.Watermark != 1 || desc.AppendLimit == nil || desc.AppendLimit.Selector != "tenant-a/*" ||
+		desc.AppendLimit.Rate != 1 || desc.AppendLimit.Available >= 1 || desc.AdvanceLimit == nil || desc.AdvanceLimit.Burst != 1 {
+		t.Errorf("unexpected description %+v", desc)
+	}
+	ng.SetRateLimits("tenant-a/*", RateLimits{})
+	if _, err := ng.AppendRecord("tenant-a/orders", 0); err != nil {
+		t.Errorf("AppendRecord after lifting the limit failed: %v", err)
+	}
+	if desc, _ := ng.Describe("tenant-a/orders"); desc.AppendLimit != nil {
+		t.Errorf("expected no limit after lifting it, got %+v", desc.AppendLimit)
+	}
+
+	// Inspecting a key whose default stream is empty reports it as empty and does
+	// not create its files.
+	group, _ := ng.Group("tenant-d/orders", "eu")
+	if _, err := group.AppendRecord(0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+	if desc, err := ng.Describe("tenant-d/orders"); err != nil || desc.TotalRecords != 0 || desc.Watermark != 0 {
+		t.Errorf("Describe of an empty default stream = %+v, %v", desc, err)
+	}
+	if report, err := ng.Gaps("tenant-d/orders"); err != nil || report.TotalRecords != 0 {
+		t.Errorf("Gaps of an empty default stream = %+v, %v", report, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := ng.Watch(ctx, "tenant-d/orders", WatchFrom(1)); err != nil {
+		t.Errorf("Watch of an empty default stream failed: %v", err)
+	}
+	cancel()
+	if _, err := os.Stat(ng.buildFilePath("tenant-d/orders")); !os.IsNotExist(err) {
+		t.Errorf("expected no data file for the default stream, got %v", err)
+	}
+}
+
+func TestAppendMulti(t *testing.T) {
+	base := t.TempDir()
+	ng := newGenerator(t, base)
+
+	ng.AppendRecord("orders", 0)
+	ng.AppendRecord("orders", 0)
+	numbers, err := ng.AppendMulti([]string{"orders", "customers"}, 0)
+	if err != nil || fmt.Sprint(numbers) != "[3 1]" {
+		t.Fatalf("AppendMulti = %v, %v", numbers, err)
+	}
+	if _, err := ng.AppendMulti([]string{"orders", "orders"}, 0); err == nil {
+		t.Error("expected a repeated key to be rejected")
+	}
+
+	// Overlapping calls lock their keys in the same order and cannot deadlock.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		keys := []string{"a", "b", "c"}
+		if i%2 == 1 {
+			keys = []string{"c", "a"}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := ng.AppendMulti(keys, 0); err != nil {
+					t.Errorf("AppendMulti failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for key, want := range map[string]uint64{"a": 80, "b": 40, "c": 80} {
+		if last, _ := ng.GetLastNumber(key); last != want {
+			t.Errorf("GetLastNumber(%q) = %d, want %d", key, last, want)
+		}
+	}
+
+	// Simulate a crash after the intent was logged and only the first key was written.
+	in := intent{ID: "crashed", Time: time.Now(), Entries: []intentEntry{
+		{Key: "customers", Number: 2, Filename: "customer-record"},
+		{Key: "orders", Number: 4, Filename: "order-record"},
+	}}
+	if _, err := ng.writeIntent(in); err != nil {
+		t.Fatalf("writeIntent failed: %v", err)
+	}
+	unlock := ng.lockStream(stream{primaryKey: "customers"})
+	ng.appendLocked(stream{primaryKey: "customers"}, 0, "customer-record", nil, in.Time)
+	unlock()
+	ng.Close()
+
+	ng = newGenerator(t, base)
+	defer ng.Close()
+	for key, want := range map[string]uint64{"customers": 2, "orders": 4} {
+		if last, _ := ng.GetLastNumber(key); last != want {
+			t.Errorf("GetLastNumber(%q) after recovery = %d, want %d", key, last, want)
+		}
+	}
+	if name, _ := ng.GetFilename("orders", 4); !strings.HasPrefix(name, "order-record") {
+		t.Errorf("recovered record has filename %q", name)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(base, intentsDirName)); len(entries) != 0 {
+		t.Errorf("expected the intent to be removed, found %d entries", len(entries))
+	}
+
+	// A call that fails after writing the first key fences both keys off until its
+	// intent is completed, so the intent still fits them on the next start.
+	blocker := ng.buildDepsPath(stream{primaryKey: "right"})
+	os.MkdirAll(blocker, 0755)
+	if _, err := ng.AppendMulti([]string{"left", "right"}, 0); err == nil {
+		t.Fatal("expected AppendMulti to fail")
+	}
+	if _, err := ng.AppendRecord("left", 0); !errors.Is(err, ErrIntentPending) {
+		t.Errorf("AppendRecord on a fenced key = %v, want ErrIntentPending", err)
+	}
+	os.RemoveAll(blocker)
+	if n, err := ng.AppendRecord("left", 0); err != nil || n != 2 {
+		t.Errorf("AppendRecord after the intent completed = %d, %v", n, err)
+	}
+	if last, _ := ng.GetLastNumber("right"); last != 1 {
+		t.Errorf("GetLastNumber(right) after the intent completed = %d, want 1", last)
+	}
+	ng.Close()
+	newGenerator(t, base).Close()
+}
+
+func TestDependenciesHoldTheGate(t *testing.T) {
+	base := t.TempDir()
+	ng := newGenerator(t, base)
+	ctx := context.Background()
+
+	ng.AppendRecord("payments", 0)
+	payment := Dependency{Key: "payments", Number: 1}
+	if n, err := ng.AppendRecordAfter(ctx, "orders", 0, payment); err != nil || n != 1 {
+		t.Fatalf("AppendRecordAfter = %d, %v", n, err)
+	}
+	ng.AppendRecord("orders", 0)
+	if _, err := ng.AppendRecordAfter(ctx, "orders", 0, Dependency{Key: "orders", Number: 1}); err == nil {
+		t.Error("expected a dependency on the own stream to be rejected")
+	}
+	if _, err := ng.AppendRecordAfter(ctx, "orders", 0, Dependency{Key: "payments"}); err == nil {
+		t.Error("expected a dependency without a number to be rejected")
+	}
+
+	if matched, err := ng.UpdateStatusIfMatch("orders", 1); err != nil || matched {
+		t.Fatalf("UpdateStatusIfMatch with an unmet dependency = %v, %v", matched, err)
+	}
+	turn := make(chan error, 1)
+	go func() { turn <- ng.WaitForTurn(ctx, "orders", 1) }()
+	select {
+	case err := <-turn:
+		t.Fatalf("WaitForTurn returned before the dependency was met: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ng.UpdateStatusIfMatch("payments", 1)
+	select {
+	case err := <-turn:
+		if err != nil {
+			t.Fatalf("WaitForTurn failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForTurn did not return once the dependency was met")
+	}
+	if matched, err := ng.UpdateStatusIfMatch("orders", 1); err != nil || !matched {
+		t.Fatalf("UpdateStatusIfMatch with a met dependency = %v, %v", matched, err)
+	}
+
+	// Simulate an append that logged its dependencies but crashed before the record
+	// was counted, then reopen: the next record must not inherit them.
+	f, err := os.OpenFile(ng.buildDepsPath(stream{primaryKey: "orders"}), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("opening the dependencies file: %v", err)
+	}
+	f.WriteString(`{"number":3,"depends_on":[{"key":"payments","number":9}]}` + "\n")
+	f.Close()
+	ng.Close()
+
+	ng = newGenerator(t, base)
+	defer ng.Close()
+	if deps, err := ng.Dependencies("orders", 1); err != nil || len(deps) != 1 || deps[0] != payment {
+		t.Errorf("Dependencies after reopening = %v, %v", deps, err)
+	}
+	ng.AppendRecord("orders", 0)
+	if deps, _ := ng.Dependencies("orders", 3); len(deps) != 0 {
+		t.Errorf("record 3 inherited the dependencies %v of an incomplete append", deps)
+	}
+
+	// Dependencies travel with snapshots and exports.
+	var snapshot, export bytes.Buffer
+	if err := ng.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := ng.Export(&export, "orders"); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	for name, load := range map[string]func(*NumberGenerator) error{
+		"Restore": func(other *NumberGenerator) error { return other.Restore(&snapshot) },
+		"Import":  func(other *NumberGenerator) error { return other.Import(&export) },
+	} {
+		other := newGenerator(t, t.TempDir())
+		if err := load(other); err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if deps, err := other.Dependencies("orders", 1); err != nil || len(deps) != 1 || deps[0] != payment {
+			t.Errorf("Dependencies after %s = %v, %v", name, deps, err)
+		}
+		other.Close()
+	}
+}
+
+func TestGlobalSequence(t *testing.T) {
+	base := t.TempDir()
+	ng := newGenerator(t, base, WithGlobalSequence())
+
+	group, _ := ng.Group("orders", "eu")
+	ng.AppendRecord("orders", 0)
+	ng.AppendRecord("payments", 0)
+	group.AppendRecord(0)
+	ng.AppendRecord("orders", 0)
+	if seq, err := ng.GlobalSequence("orders", 2); err != nil || seq != 4 {
+		t.Fatalf("GlobalSequence(orders, 2) = %d, %v", seq, err)
+	}
+	if seq, err := group.GlobalSequence(1); err != nil || seq != 3 {
+		t.Fatalf("group GlobalSequence(1) = %d, %v", seq, err)
+	}
+
+	// The watermark only passes a sequence number once every record up to it is done.
+	for _, step := range []struct {
+		done      func() error
+		watermark uint64
+	}{
+		{func() error { return ng.UpdateStatuses("orders", []uint64{1}) }, 1},
+		{func() error { return ng.UpdateStatuses("orders", []uint64{2}) }, 1},
+		{func() error { return ng.UpdateStatuses("payments", []uint64{1}) }, 2},
+		{func() error { return group.UpdateStatuses([]uint64{1}) }, 4},
+	} {
+		if err := step.done(); err != nil {
+			t.Fatalf("UpdateStatuses failed: %v", err)
+		}
+		if watermark, err := ng.GlobalWatermark(); err != nil || watermark != step.watermark {
+			t.Fatalf("GlobalWatermark = %d, %v, want %d", watermark, err, step.watermark)
+		}
+	}
+
+	// Simulate an append that logged its sequence number but crashed before the
+	// record was counted; reopening voids the entry.
+	ng.AppendRecord("payments", 0)
+	s := stream{primaryKey: "orders"}
+	unlock := ng.lockStream(s)
+	ng.stampLocked(s, 3)
+	unlock()
+	ng.Close()
+
+	ng = newGenerator(t, base, WithGlobalSequence())
+	defer ng.Close()
+	if watermark, _ := ng.GlobalWatermark(); watermark != 4 {
+		t.Errorf("GlobalWatermark after reopening = %d, want 4", watermark)
+	}
+	ng.AppendRecord("orders", 0)
+	ng.UpdateStatuses("payments", []uint64{2})
+	if watermark, _ := ng.GlobalWatermark(); watermark != 6 {
+		t.Errorf("GlobalWatermark past the void entry = %d, want 6", watermark)
+	}
+
+	replay := func(ng *NumberGenerator) string {
+		var order []string
+		err := ng.ReplayGlobal(2, func(r GlobalRecord) error {
+			order = append(order, fmt.Sprintf("%d:%s/%s#%d:%v", r.Sequence, r.PrimaryKey, r.Group, r.Number, r.Done))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ReplayGlobal failed: %v", err)
+		}
+		return strings.Join(order, " ")
+	}
+	want := "2:payments/#1:true 3:orders/eu#1:true 4:orders/#2:true 5:payments/#2:true 7:orders/#3:false"
+	if got := replay(ng); got != want {
+		t.Errorf("ReplayGlobal = %s, want %s", got, want)
+	}
+
+	var snapshot bytes.Buffer
+	if err := ng.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	other := newGenerator(t, t.TempDir(), WithGlobalSequence())
+	defer other.Close()
+	if err := other.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got := replay(other); got != want {
+		t.Errorf("ReplayGlobal after Restore = %s, want %s", got, want)
+	}
+	if last, _ := other.LastGlobalSequence(); last != 7 {
+		t.Errorf("LastGlobalSequence after Restore = %d, want 7", last)
+	}
+
+	// Records the stream's watermark skips are done at once, and pending again when
+	// it moves back, as they are after a restart.
+	skipping := newGenerator(t, t.TempDir(), WithGlobalSequence())
+	defer skipping.Close()
+	for i := 0; i < 3; i++ {
+		skipping.AppendRecord("a", 0)
+	}
+	for _, step := range []struct {
+		numbers   []uint64
+		watermark uint64
+	}{{[]uint64{3}, 3}, {[]uint64{1}, 1}} {
+		if err := skipping.UpdateStatuses("a", step.numbers); err != nil {
+			t.Fatalf("UpdateStatuses failed: %v", err)
+		}
+		if watermark, err := skipping.GlobalWatermark(); err != nil || watermark != step.watermark {
+			t.Errorf("GlobalWatermark after UpdateStatuses(%v) = %d, %v, want %d", step.numbers, watermark, err, step.watermark)
+		}
+	}
+
+	// Import stamps the records it brings in after every sequence number issued,
+	// and voids the entries of the records it replaces. An import that cannot swap
+	// its files in leaves the stream and the global log as they were.
+	source := newGenerator(t, t.TempDir())
+	defer source.Close()
+	source.AppendRecord("a", 0)
+	source.AppendRecord("a", 0)
+	source.UpdateStatuses("a", []uint64{1})
+	var exported bytes.Buffer
+	if err := source.Export(&exported); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	blocker := skipping.buildSeqPath(stream{primaryKey: "a"}) + replacedFileExt
+	if err := os.MkdirAll(filepath.Join(blocker, "file"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := skipping.Import(bytes.NewReader(exported.Bytes())); err == nil {
+		t.Fatalf("Import succeeded with the seq file blocked")
+	}
+	if last, err := skipping.GetLastNumber("a"); err != nil || last != 3 {
+		t.Errorf("GetLastNumber after a failed Import = %d, %v, want 3", last, err)
+	}
+	if seq, err := skipping.GlobalSequence("a", 3); err != nil || seq != 3 {
+		t.Errorf("GlobalSequence(a, 3) after a failed Import = %d, %v, want 3", seq, err)
+	}
+	os.RemoveAll(blocker)
+	if err := skipping.Import(&exported); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	for number, want := range map[uint64]uint64{1: 6, 2: 7} {
+		if seq, err := skipping.GlobalSequence("a", number); err != nil || seq != want {
+			t.Errorf("GlobalSequence(a, %d) after Import = %d, %v, want %d", number, seq, err, want)
+		}
+	}
+	if watermark, err := skipping.GlobalWatermark(); err != nil || watermark != 6 {
+		t.Errorf("GlobalWatermark after Import = %d, %v, want 6", watermark, err)
+	}
+
+	plain := newGenerator(t, t.TempDir())
+	defer plain.Close()
+	if _, err := plain.GlobalWatermark(); !errors.Is(err, ErrNoGlobalSequence) {
+		t.Errorf("GlobalWatermark without the option = %v", err)
+	}
+
+	// A record appended with status 1 is not done until the watermark reaches it.
+	ng.AppendRecord("refunds", 1)
+	seen := false
+	ng.ReplayGlobal(8, func(r GlobalRecord) error {
+		if r.PrimaryKey == "refunds" {
+			seen = true
+			if r.Done {
+				t.Errorf("record appended with status 1 replayed as done: %+v", r)
+			}
+		}
+		return nil
+	})
+	if !seen {
+		t.Error("record appended with status 1 was not replayed")
+	}
+}
+
+func TestRewind(t *testing.T) {
+	ng := newGenerator(t, t.TempDir(), WithGlobalSequence())
+	defer ng.Close()
+	var mutations []Mutation
+	ng.AddMutationHook(func(m Mutation) error {
+		mutations = append(mutations, m)
+		return nil
+	})
+
+	for i := 0; i < 5; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	ng.UpdateStatuses("orders", []uint64{1, 2, 3, 4})
+
+	if err := ng.Rewind("orders", 2); !errors.Is(err, ErrRewindNotConfirmed) {
+		t.Fatalf("Rewind without confirmation = %v", err)
+	}
+	if watermark, _ := ng.GetLastUpdateNumber("orders"); watermark != 4 {
+		t.Fatalf("an unconfirmed Rewind moved the watermark to %d", watermark)
+	}
+	if err := ng.Rewind("orders", 6, ConfirmRewind()); err == nil {
+		t.Error("expected a rewind past the last record to fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := ng.Watch(ctx, "orders")
+	if err := ng.Rewind("orders", 2, ConfirmRewind()); err != nil {
+		t.Fatalf("Rewind failed: %v", err)
+	}
+	if e := <-events; e.Type != EventRewound || e.Number != 3 || e.Watermark != 2 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if watermark, _ := ng.GetLastUpdateNumber("orders"); watermark != 2 {
+		t.Errorf("GetLastUpdateNumber after Rewind = %d, want 2", watermark)
+	}
+	for number, want := range map[uint64]byte{2: 1, 3: 0, 4: 0} {
+		if status, _ := ng.GetStatus("orders", number); status != want {
+			t.Errorf("status of %d after Rewind = %d, want %d", number, status, want)
+		}
+	}
+	if watermark, _ := ng.GlobalWatermark(); watermark != 2 {
+		t.Errorf("GlobalWatermark after Rewind = %d, want 2", watermark)
+	}
+	if n, _ := ng.AppendRecord("orders", 0); n != 6 {
+		t.Errorf("AppendRecord after Rewind = %d, want 6", n)
+	}
+	if matched, _ := ng.UpdateStatusIfMatch("orders", 3); !matched {
+		t.Error("expected record 3 to be next in line after Rewind")
+	}
+
+	// Replicas follow the rewind.
+	replica := newGenerator(t, t.TempDir())
+	defer replica.Close()
+	for _, m := range mutations {
+		if err := replica.ApplyMutation(m); err != nil {
+			t.Fatalf("ApplyMutation(%s) failed: %v", m.Type, err)
+		}
+	}
+	if watermark, _ := replica.GetLastUpdateNumber("orders"); watermark != 3 {
+		t.Errorf("replica GetLastUpdateNumber = %d, want 3", watermark)
+	}
+	if status, _ := replica.GetStatus("orders", 4); status != 0 {
+		t.Errorf("replica status of 4 = %d, want 0", status)
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+	replica := newGenerator(t, t.TempDir())
+	defer replica.Close()
+	ng.AddMutationHook(replica.ApplyMutation)
+
+	for i := 0; i < 3; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	billing, _ := ng.Consumer("orders", "billing")
+	shipping, _ := ng.Consumer("orders", "shipping")
+	if _, err := ng.Consumer("orders", "a/b"); err == nil {
+		t.Error("expected an invalid consumer name to be rejected")
+	}
+
+	if matched, err := billing.UpdateStatusIfMatch(1); err != nil || !matched {
+		t.Fatalf("billing UpdateStatusIfMatch(1) = %v, %v", matched, err)
+	}
+	if matched, _ := shipping.UpdateStatusIfMatch(2); matched {
+		t.Error("shipping matched record 2 before record 1")
+	}
+	if watermark, _ := shipping.GetLastUpdateNumber(); watermark != 0 {
+		t.Errorf("shipping watermark = %d, want 0", watermark)
+	}
+	if status, _ := ng.GetStatus("orders", 1); status != 0 {
+		t.Error("a consumer group changed the key's own status")
+	}
+
+	// Exactly one of many concurrent callers matches.
+	var matches int
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if matched, err := billing.UpdateStatusIfMatch(2); err == nil && matched {
+				mu.Lock()
+				matches++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if matches != 1 {
+		t.Errorf("%d concurrent callers matched record 2, want 1", matches)
+	}
+
+	ctx := context.Background()
+	turn := make(chan error, 1)
+	go func() { turn <- shipping.WaitForTurn(ctx, 3) }()
+	shipping.UpdateStatuses([]uint64{1, 2})
+	if err := <-turn; err != nil {
+		t.Fatalf("WaitForTurn failed: %v", err)
+	}
+
+	// Dependencies are checked against the consumer group of the same name.
+	ng.AppendRecord("payments", 0)
+	ng.AppendRecordAfter(ctx, "orders", 0, Dependency{Key: "payments", Number: 1})
+	billing.UpdateStatuses([]uint64{3})
+	ng.UpdateStatuses("payments", []uint64{1})
+	if matched, _ := billing.UpdateStatusIfMatch(4); matched {
+		t.Error("billing matched record 4 before its payment was billed")
+	}
+	paymentsBilling, _ := ng.Consumer("payments", "billing")
+	paymentsBilling.UpdateStatuses([]uint64{1})
+	if matched, _ := billing.UpdateStatusIfMatch(4); !matched {
+		t.Error("billing did not match record 4 after its payment was billed")
+	}
+
+	if err := billing.Rewind(1, ConfirmRewind()); err != nil {
+		t.Fatalf("Rewind failed: %v", err)
+	}
+	if status, _ := billing.GetStatus(2); status != 0 {
+		t.Errorf("billing status of 2 after Rewind = %d, want 0", status)
+	}
+	if watermark, _ := shipping.GetLastUpdateNumber(); watermark != 2 {
+		t.Errorf("shipping watermark after rewinding billing = %d, want 2", watermark)
+	}
+
+	var snapshot bytes.Buffer
+	if err := ng.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	restored := newGenerator(t, t.TempDir())
+	defer restored.Close()
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for name, other := range map[string]*NumberGenerator{"original": ng, "replica": replica, "restored": restored} {
+		if desc, _ := other.Describe("orders"); fmt.Sprint(desc.Consumers) != "[billing shipping]" {
+			t.Errorf("%s: Consumers = %v", name, desc.Consumers)
+		}
+		for consumer, want := range map[string]uint64{"billing": 1, "shipping": 2} {
+			c, _ := other.Consumer("orders", consumer)
+			if watermark, err := c.GetLastUpdateNumber(); err != nil || watermark != want {
+				t.Errorf("%s: %s watermark = %d, %v, want %d", name, consumer, watermark, err, want)
+			}
+		}
+	}
+}
+
+func TestProcessInOrder(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+
+	// Started in reverse, the functions still run in record order.
+	var mu sync.Mutex
+	var order []uint64
+	var wg sync.WaitGroup
+	for number := uint64(3); number >= 1; number-- {
+		wg.Add(1)
+		go func(number uint64) {
+			defer wg.Done()
+			err := ng.ProcessInOrder(ctx, "orders", number, func() error {
+				mu.Lock()
+				order = append(order, number)
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Errorf("ProcessInOrder(%d): %v", number, err)
+			}
+		}(number)
+	}
+	wg.Wait()
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("processing order = %v, want [1 2 3]", order)
+	}
+	if watermark, _ := ng.GetLastUpdateNumber("orders"); watermark != 3 {
+		t.Fatalf("watermark = %d, want 3", watermark)
+	}
+
+	ran := false
+	if err := ng.ProcessInOrder(ctx, "orders", 2, func() error { ran = true; return nil }); !errors.Is(err, ErrAlreadyDone) || ran {
+		t.Errorf("ProcessInOrder of a done record = %v, ran %v; want ErrAlreadyDone without running", err, ran)
+	}
+	if err := ng.ProcessInOrder(ctx, "payments", 1, func() error { ran = true; return nil }); !errors.Is(err, ErrRecordNotFound) || ran {
+		t.Errorf("ProcessInOrder of a missing record = %v, ran %v; want ErrRecordNotFound without running", err, ran)
+	}
+
+	// A failing function is retried and the record is only done once it succeeds.
+	attempts := 0
+	policy := WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	err := ng.ProcessInOrder(ctx, "orders", 4, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	}, policy)
+	if err != nil || attempts != 3 {
+		t.Fatalf("ProcessInOrder with retries = %v after %d attempts", err, attempts)
+	}
+
+	// Once the policy gives up, the error is returned and shown by Gaps.
+	failure := errors.New("downstream unavailable")
+	err = ng.ProcessInOrder(ctx, "orders", 5, func() error { return failure }, policy)
+	var processErr *ProcessError
+	if !errors.As(err, &processErr) || !errors.Is(err, failure) || processErr.Attempts != 3 {
+		t.Fatalf("ProcessInOrder of a failing function = %v", err)
+	}
+	report, _ := ng.Gaps("orders")
+	if len(report.Pending) != 1 || report.Pending[0].Attempts != 3 || report.Pending[0].LastError != failure.Error() {
+		t.Errorf("Gaps after failures = %+v", report.Pending)
+	}
+	if err := ng.ProcessInOrder(ctx, "orders", 5, func() error { return nil }); err != nil {
+		t.Fatalf("ProcessInOrder after failures: %v", err)
+	}
+	if report, _ := ng.Gaps("orders"); len(report.Pending) != 0 {
+		t.Errorf("Gaps after success = %+v", report.Pending)
+	}
+
+	// Consumer groups process at their own pace.
+	billing, _ := ng.Consumer("orders", "billing")
+	if err := billing.ProcessInOrder(ctx, 1, func() error { return nil }); err != nil {
+		t.Fatalf("Consumer.ProcessInOrder: %v", err)
+	}
+	if watermark, _ := billing.GetLastUpdateNumber(); watermark != 1 {
+		t.Errorf("billing watermark = %d, want 1", watermark)
+	}
+}
+
+func TestCompareAndAdvanceIsLinearizable(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	const records = 200
+	for i := 0; i < records; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	if _, err := ng.CompareAndAdvance("orders", 3, 3); err == nil {
+		t.Error("expected an empty advance to be rejected")
+	}
+	if advanced, _ := ng.CompareAndAdvance("orders", records, records+1); advanced {
+		t.Error("advanced past the last record")
+	}
+	if advanced, err := ng.CompareAndAdvance("orders", 0, math.MaxUint64); advanced || err != nil {
+		t.Errorf("CompareAndAdvance past the last record = %v, %v", advanced, err)
+	}
+
+	// Writers race from whatever watermark they observed. Every expected value may
+	// only be advanced from once, and the successful advances must form one chain.
+	var mu sync.Mutex
+	advances := make(map[uint64]uint64)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for {
+				watermark, err := ng.GetLastUpdateNumber("orders")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if watermark == records {
+					return
+				}
+				next := watermark + 1 + uint64(rng.Intn(3))
+				if next > records {
+					next = records
+				}
+				advanced, err := ng.CompareAndAdvance("orders", watermark, next)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if advanced {
+					mu.Lock()
+					if previous, ok := advances[watermark]; ok {
+						t.Errorf("advanced from %d twice, to %d and %d", watermark, previous, next)
+					}
+					advances[watermark] = next
+					mu.Unlock()
+				}
+			}
+		}(int64(i))
+	}
+
+	// UpdateStatusIfMatch races against CompareAndAdvance on the same key.
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := uint64(1); number <= records; number++ {
+				matched, err := ng.UpdateStatusIfMatch("orders", number)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if matched {
+					mu.Lock()
+					if previous, ok := advances[number-1]; ok {
+						t.Errorf("advanced from %d twice, to %d and %d", number-1, previous, number)
+					}
+					advances[number-1] = number
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	watermark := uint64(0)
+	for watermark < records {
+		next, ok := advances[watermark]
+		if !ok {
+			t.Fatalf("no advance from %d", watermark)
+		}
+		delete(advances, watermark)
+		watermark = next
+	}
+	if len(advances) != 0 {
+		t.Errorf("advances outside the chain: %v", advances)
+	}
+	for number := uint64(1); number <= records; number++ {
+		if status, _ := ng.GetStatus("orders", number); status != 1 {
+			t.Fatalf("record %d was skipped", number)
+		}
+	}
+}
+
+func TestTryAdvanceResults(t *testing.T) {
+	ng := newGenerator(t, t.TempDir())
+	defer ng.Close()
+
+	for i := 0; i < 4; i++ {
+		ng.AppendRecord("orders", 0)
+	}
+	ng.AppendRecord("payments", 0)
+	ng.AppendRecordAfter(context.Background(), "orders", 0, Dependency{Key: "payments", Number: 1})
+
+	steps := []struct {
+		number uint64
+		want   AdvanceResult
+	}{
+		{2, NotYetTurn},
+		{1, Advanced},
+		{1, AlreadyDone}, // A redelivery
+		{9, Unknown},
+		{0, Unknown},
+	}
+	for _, step := range steps {
+		if got, err := ng.TryAdvance("orders", step.number); err != nil || got != step.want {
+			t.Errorf("TryAdvance(%d) = %v, %v; want %v", step.number, got, err, step.want)
+		}
+	}
+
+	// A record the watermark passed without marking it cannot be classified.
+	ng.UpdateStatuses("orders", []uint64{4})
+	if got, _ := ng.TryAdvance("orders", 3); got != Unknown {
+		t.Errorf("TryAdvance of a skipped record = %v, want %v", got, Unknown)
+	}
+	if got, _ := ng.TryAdvance("orders", 4); got != AlreadyDone {
+		t.Errorf("TryAdvance of a record done out of order = %v, want %v", got, AlreadyDone)
+	}
+
+	// A pending dependency is not the record's turn yet.
+	if got, _ := ng.TryAdvance("orders", 5); got != NotYetTurn {
+		t.Errorf("TryAdvance with an unmet dependency = %v, want %v", got, NotYetTurn)
+	}
+	ng.UpdateStatuses("payments", []uint64{1})
+	if got, _ := ng.TryAdvance("orders", 5); got != Advanced {
+		t.Errorf("TryAdvance with a met dependency = %v, want %v", got, Advanced)
+	}
+
+	// A record appended with status 1 is still advanced at its turn.
+	ng.AppendRecord("refunds", 1)
+	ng.AppendRecord("refunds", 1)
+	if got, _ := ng.TryAdvance("refunds", 2); got != NotYetTurn {
+		t.Errorf("TryAdvance of an early record appended as done = %v, want %v", got, NotYetTurn)
+	}
+	if matched, err := ng.UpdateStatusIfMatch("refunds", 1); err != nil || !matched {
+		t.Errorf("UpdateStatusIfMatch of a record appended as done = %v, %v", matched, err)
+	}
+	if got, _ := ng.TryAdvance("refunds", 2); got != Advanced {
+		t.Errorf("TryAdvance of a record appended as done = %v, want %v", got, Advanced)
+	}
+	if watermark, _ := ng.GetLastUpdateNumber("refunds"); watermark != 2 {
+		t.Errorf("refunds watermark = %d, want 2", watermark)
+	}
+
+	billing, _ := ng.Consumer("orders", "billing")
+	if got, _ := billing.TryAdvance(1); got != Advanced {
+		t.Errorf("Consumer.TryAdvance(1) = %v, want %v", got, Advanced)
+	}
+	if got, _ := billing.TryAdvance(1); got != AlreadyDone {
+		t.Errorf("Consumer.TryAdvance(1) again = %v, want %v", got, AlreadyDone)
+	}
+}
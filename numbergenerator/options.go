@@ -0,0 +1,55 @@
+package numbergenerator
+
+import (
+	"log/slog"
+
+	vmoformat "queueguard/vmofile"
+)
+
+// Option configures a NumberGenerator.
+type Option func(*NumberGenerator)
+
+// WithFanOut nests every key directory below levels directories named after
+// two-character prefixes of the key's hash, so that no single directory has to hold
+// all keys. Changing the fan-out of an existing base path relocates its keys on the
+// next start.
+func WithFanOut(levels int) Option {
+	return func(ng *NumberGenerator) {
+		ng.fanOut = levels
+	}
+}
+
+// WithMaxOpenFiles bounds the number of stream files kept open at the same time.
+// When the limit is reached the least recently used idle handle is closed; it is
+// reopened transparently on its next use. A limit of 0 keeps every file open.
+func WithMaxOpenFiles(n int) Option {
+	return func(ng *NumberGenerator) {
+		ng.maxOpenFiles = n
+	}
+}
+
+// WithReadOnly opens the base path for inspection only. The generator takes a
+// shared lock instead of an exclusive one, never creates or migrates data files, and
+// rejects mutating calls with ErrReadOnly.
+func WithReadOnly() Option {
+	return func(ng *NumberGenerator) {
+		ng.readOnly = true
+	}
+}
+
+// WithSegments includes the vmoformat segment files in Snapshot and Restore.
+func WithSegments(files *vmoformat.VMOFiles) Option {
+	return func(ng *NumberGenerator) {
+		ng.segments = files
+	}
+}
+
+// WithLogger sets the logger used for errors that cannot be returned to a
+// caller, e.g. from background goroutines. slog.Default() is used otherwise.
+func WithLogger(logger *slog.Logger) Option {
+	return func(ng *NumberGenerator) {
+		if logger != nil {
+			ng.logger = logger
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package numbergenerator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultRetryBackoff is the delay before the first retry of a RetryPolicy that
+// does not set one.
+const defaultRetryBackoff = 100 * time.Millisecond
+
+var (
+	// ErrAlreadyDone is returned by ProcessInOrder when the watermark passed the
+	// record before its function ran, e.g. because another process handled it.
+	ErrAlreadyDone = errors.New("record is already done")
+
+	// ErrTurnLost is returned by ProcessInOrder when the function succeeded but the
+	// watermark was moved by another writer in the meantime, so the record was not
+	// marked as done.
+	ErrTurnLost = errors.New("turn was taken by another writer")
+
+	// ErrRecordNotFound is returned by ProcessInOrder when its turn came but the
+	// record was never appended.
+	ErrRecordNotFound = errors.New("record does not exist")
+)
+
+// RetryPolicy controls how often ProcessInOrder runs a failing function.
+type RetryPolicy struct {
+	MaxAttempts int              // Runs in total including the first, 0 retries until ctx is done
+	Backoff     time.Duration    // Delay before the first retry, doubled for every further one; 100ms if 0
+	MaxBackoff  time.Duration    // Upper bound of the delay, 0 means unbounded
+	Retryable   func(error) bool // Reports whether an error may be retried, nil retries every error
+}
+
+// delay returns the backoff before the retry following attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = defaultRetryBackoff
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// retry reports whether another attempt follows a failed attempt.
+func (p RetryPolicy) retry(attempt int, err error) bool {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// ProcessOption configures a call to ProcessInOrder.
+type ProcessOption func(*processConfig)
+
+type processConfig struct {
+	policy RetryPolicy
+}
+
+// WithRetry retries a failing function according to policy. Without it the
+// function runs once.
+func WithRetry(policy RetryPolicy) ProcessOption {
+	return func(cfg *processConfig) {
+		cfg.policy = policy
+	}
+}
+
+// ProcessError is returned by ProcessInOrder when the function kept failing. The
+// record was not marked as done.
+type ProcessError struct {
+	PrimaryKey string
+	Group      string
+	Consumer   string
+	Number     uint64
+	Attempts   int
+	Err        error // Returned by the last attempt
+}
+
+func (e *ProcessError) Error() string {
+	key := stream{primaryKey: e.PrimaryKey, group: e.Group}.cacheKey()
+	if e.Consumer != "" {
+		key += " for " + e.Consumer
+	}
+	return fmt.Sprintf("processing record %d of %q failed after %d attempts: %v", e.Number, key, e.Attempts, e.Err)
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// turnKey identifies whose turn a ProcessInOrder call holds: a stream, or one of
+// its consumer groups.
+type turnKey struct {
+	stream   stream
+	consumer string
+}
+
+// processFailure is the last failure of a ProcessInOrder call, reported by Gaps.
+type processFailure struct {
+	number   uint64
+	attempts int
+	err      string
+}
+
+// ProcessInOrder waits until it is number's turn in primaryKey, see WaitForTurn,
+// runs fn while holding the turn and marks the record as done if fn succeeds.
+// Other ProcessInOrder calls for the key wait until the turn is released, so fn
+// never runs for two records of the key at the same time.
+//
+// When fn fails, the error is logged and reported by Gaps for the record, and fn
+// is retried according to the policy set WithRetry. Once the policy gives up, a
+// *ProcessError is returned and the record stays pending. fn is not run at all
+// if the record is already done, in which case ErrAlreadyDone is returned, or if
+// it was not appended, in which case ErrRecordNotFound is returned.
+func (ng *NumberGenerator) ProcessInOrder(ctx context.Context, primaryKey string, number uint64, fn func() error, opts ...ProcessOption) error {
+	return ng.processInOrder(ctx, turnKey{stream: stream{primaryKey: primaryKey}}, number, fn, opts)
+}
+
+func (ng *NumberGenerator) processInOrder(ctx context.Context, key turnKey, number uint64, fn func() error, opts []ProcessOption) (err error) {
+	s := key.stream
+	ctx, span := ng.startSpan(ctx, "queueguard.ProcessInOrder", s, Attribute{"queueguard.number", number})
+	defer func() { endSpan(span, err) }()
+	if key.consumer != "" {
+		span.SetAttributes(Attribute{"queueguard.consumer", key.consumer})
+	}
+
+	if err := validateKey(s.primaryKey); err != nil {
+		return err
+	}
+	if number == 0 {
+		return fmt.Errorf("record numbers start at 1")
+	}
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+	cfg := processConfig{policy: RetryPolicy{MaxAttempts: 1}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	for {
+		if _, err := ng.awaitTurn(ctx, s, key.consumer, number); err != nil {
+			return err
+		}
+		release, err := ng.acquireTurn(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		// Another call for the same number may have finished while this one waited
+		// for the turn, or the stream may have been rewound. The turn of the number
+		// after the last record comes without it being appended.
+		unlock := ng.lockStream(s)
+		total, watermark, err := ng.positionLocked(s, key.consumer)
+		unlock()
+		switch {
+		case err != nil:
+		case number > total:
+			err = fmt.Errorf("%w: %d of %q", ErrRecordNotFound, number, s.cacheKey())
+		case watermark >= number:
+			err = ErrAlreadyDone
+		case watermark+1 < number:
+			release()
+			continue
+		default:
+			err = ng.runTurn(ctx, key, number, fn, cfg.policy, span)
+		}
+		release()
+		return err
+	}
+}
+
+// runTurn runs fn until it succeeds or the policy gives up, and marks the record as
+// done after it succeeded. The caller must hold the turn.
+func (ng *NumberGenerator) runTurn(ctx context.Context, key turnKey, number uint64, fn func() error, policy RetryPolicy, span Span) error {
+	s := key.stream
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			break
+		}
+
+		ng.recordFailure(key, number, attempt, err)
+		span.RecordError(err)
+		ng.logger.Warn("processing record failed", "key", s.primaryKey, "group", s.group, "consumer", key.consumer,
+			"number", number, "attempt", attempt, "error", err)
+		if !policy.retry(attempt, err) {
+			return &ProcessError{
+				PrimaryKey: s.primaryKey,
+				Group:      s.group,
+				Consumer:   key.consumer,
+				Number:     number,
+				Attempts:   attempt,
+				Err:        err,
+			}
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if err := ng.takeTokens(ctx, s.primaryKey, opAdvance, 1, true); err != nil {
+		return err
+	}
+	matched, err := func() (matched bool, err error) {
+		defer ng.lockMutation(s)(&err)
+		return ng.compareAndAdvanceLocked(s, key.consumer, number-1, number)
+	}()
+	if err != nil || !matched {
+		ng.refundTokens(s.primaryKey, opAdvance, 1)
+	}
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return ErrTurnLost
+	}
+	ng.clearFailure(key, number)
+	return nil
+}
+
+// acquireTurn waits until no other ProcessInOrder call holds the turn of key and
+// takes it. The returned function releases it.
+func (ng *NumberGenerator) acquireTurn(ctx context.Context, key turnKey) (func(), error) {
+	ng.lock.Lock()
+	if ng.turns == nil {
+		ng.turns = make(map[turnKey]chan struct{})
+	}
+	turn, ok := ng.turns[key]
+	if !ok {
+		turn = make(chan struct{}, 1)
+		ng.turns[key] = turn
+	}
+	ng.lock.Unlock()
+
+	select {
+	case turn <- struct{}{}:
+		return func() { <-turn }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// recordFailure remembers the failed attempt of a record for Gaps.
+func (ng *NumberGenerator) recordFailure(key turnKey, number uint64, attempts int, err error) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if ng.failures == nil {
+		ng.failures = make(map[turnKey]processFailure)
+	}
+	ng.failures[key] = processFailure{number: number, attempts: attempts, err: err.Error()}
+}
+
+// clearFailure forgets the failures of a record once it was processed.
+func (ng *NumberGenerator) clearFailure(key turnKey, number uint64) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	if failure, ok := ng.failures[key]; ok && failure.number <= number {
+		delete(ng.failures, key)
+	}
+}
+
+// lastFailure returns the last failure recorded for a record of a stream.
+func (ng *NumberGenerator) lastFailure(s stream, number uint64) (processFailure, bool) {
+	ng.lock.Lock()
+	defer ng.lock.Unlock()
+	failure, ok := ng.failures[turnKey{stream: s}]
+	return failure, ok && failure.number == number
+}
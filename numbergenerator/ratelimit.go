@@ -0,0 +1,254 @@
+package numbergenerator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrRateLimited is matched by the *RateLimitError returned when a call exceeds
+// the rate limit of its key.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit is a token bucket refilled at Rate tokens per second and holding at
+// most Burst tokens. A Rate of 0 means unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst int // Defaults to Rate rounded up, at least 1
+}
+
+// RateLimits are the limits applied to the keys matched by a selector. Every
+// appended record costs one Append token, every record marked as done by
+// UpdateStatuses or UpdateStatusIfMatch one Advance token.
+type RateLimits struct {
+	Append  RateLimit
+	Advance RateLimit
+}
+
+// RateLimitStatus reports the limit in effect for a key.
+type RateLimitStatus struct {
+	Selector  string // Key or key prefix the limit was set for
+	Rate      float64
+	Burst     int
+	Available float64 // Tokens left in the bucket
+}
+
+// RateLimitError reports a call rejected by a rate limit.
+type RateLimitError struct {
+	PrimaryKey string
+	Selector   string
+	Operation  string        // "append" or "advance"
+	RetryAfter time.Duration // Time until enough tokens are available
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s on %q limited by %q, retry after %s", ErrRateLimited, e.Operation, e.PrimaryKey, e.Selector, e.RetryAfter)
+}
+
+// Unwrap lets errors.Is match ErrRateLimited.
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+const (
+	opAppend  = "append"
+	opAdvance = "advance"
+)
+
+// tokenBucket is a RateLimit with its current fill level.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// refill adds the tokens earned since the last call.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// take removes n tokens and returns 0, or returns how long to wait until they are
+// available. Requests larger than the burst are let through once the bucket is
+// full and leave it in debt.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	need := math.Min(n, float64(b.limit.Burst))
+	if b.tokens >= need {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// rateRule holds the buckets of one selector. All keys matched by a prefix
+// selector share its buckets, so a prefix limits a whole tenant.
+type rateRule struct {
+	selector string
+	append   *tokenBucket
+	advance  *tokenBucket
+}
+
+// SetRateLimits limits the keys matched by selector, which is either a primary key
+// or a key prefix followed by "*", e.g. "tenant-a/*"; "*" alone matches every key.
+// An exact key takes precedence over prefixes, a longer prefix over a shorter one.
+// Limits can be changed at any time; setting zero limits removes the selector.
+//
+// AppendRecord, UpdateStatuses and UpdateStatusIfMatch fail with a
+// *RateLimitError when a limit is exceeded, while the Context variants wait for
+// tokens until their context is done.
+func (ng *NumberGenerator) SetRateLimits(selector string, limits RateLimits) error {
+	if prefix, isPrefix := strings.CutSuffix(selector, "*"); isPrefix {
+		if strings.ContainsRune(prefix, 0) {
+			return fmt.Errorf("%w: selector %q contains a NUL character", ErrInvalidKey, selector)
+		}
+	} else if err := validateKey(selector); err != nil {
+		return err
+	}
+
+	ng.rateMu.Lock()
+	defer ng.rateMu.Unlock()
+
+	if limits.Append.Rate <= 0 && limits.Advance.Rate <= 0 {
+		delete(ng.rateRules, selector)
+		return nil
+	}
+
+	now := time.Now()
+	rule := &rateRule{
+		selector: selector,
+		append:   newTokenBucket(limits.Append, now),
+		advance:  newTokenBucket(limits.Advance, now),
+	}
+	// Keep the fill level of adjusted buckets, so changing a limit does not hand
+	// out a fresh burst.
+	if previous, exists := ng.rateRules[selector]; exists {
+		keepTokens(rule.append, previous.append, now)
+		keepTokens(rule.advance, previous.advance, now)
+	}
+	if ng.rateRules == nil {
+		ng.rateRules = make(map[string]*rateRule)
+	}
+	ng.rateRules[selector] = rule
+	return nil
+}
+
+func keepTokens(bucket, previous *tokenBucket, now time.Time) {
+	if bucket == nil || previous == nil {
+		return
+	}
+	previous.refill(now)
+	bucket.tokens = math.Min(previous.tokens, float64(bucket.limit.Burst))
+}
+
+// matchRuleLocked returns the rule applying to primaryKey, or nil. The caller
+// must hold ng.rateMu.
+func (ng *NumberGenerator) matchRuleLocked(primaryKey string) *rateRule {
+	if rule, exists := ng.rateRules[primaryKey]; exists {
+		return rule
+	}
+	var best *rateRule
+	for selector, rule := range ng.rateRules {
+		prefix, isPrefix := strings.CutSuffix(selector, "*")
+		if !isPrefix || !strings.HasPrefix(primaryKey, prefix) {
+			continue
+		}
+		if best == nil || len(selector) > len(best.selector) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// rateLimitStatus reports the limit of an operation on primaryKey, nil if it is unlimited.
+func (ng *NumberGenerator) rateLimitStatus(primaryKey, op string) *RateLimitStatus {
+	ng.rateMu.Lock()
+	defer ng.rateMu.Unlock()
+
+	rule := ng.matchRuleLocked(primaryKey)
+	if rule == nil {
+		return nil
+	}
+	bucket := rule.bucket(op)
+	if bucket == nil {
+		return nil
+	}
+	bucket.refill(time.Now())
+	return &RateLimitStatus{
+		Selector:  rule.selector,
+		Rate:      bucket.limit.Rate,
+		Burst:     bucket.limit.Burst,
+		Available: bucket.tokens,
+	}
+}
+
+func (r *rateRule) bucket(op string) *tokenBucket {
+	if op == opAppend {
+		return r.append
+	}
+	return r.advance
+}
+
+// takeTokens charges n tokens of an operation to primaryKey. Without wait it fails
+// with a *RateLimitError if they are not available, otherwise it waits for them
+// until ctx is done.
+func (ng *NumberGenerator) takeTokens(ctx context.Context, primaryKey, op string, n int, wait bool) error {
+	for {
+		ng.rateMu.Lock()
+		rule := ng.matchRuleLocked(primaryKey)
+		var delay time.Duration
+		if rule != nil {
+			if bucket := rule.bucket(op); bucket != nil {
+				delay = bucket.take(float64(n), time.Now())
+			}
+		}
+		ng.rateMu.Unlock()
+
+		if delay == 0 {
+			return nil
+		}
+		if !wait {
+			return &RateLimitError{PrimaryKey: primaryKey, Selector: rule.selector, Operation: op, RetryAfter: delay}
+		}
+
+		// Try again after the delay, the limit may have changed in the meantime.
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refundTokens returns n tokens charged by takeTokens to a call that was rejected
+// afterwards, e.g. by a full window, so that rejected calls do not use up quota.
+func (ng *NumberGenerator) refundTokens(primaryKey, op string, n int) {
+	ng.rateMu.Lock()
+	defer ng.rateMu.Unlock()
+
+	rule := ng.matchRuleLocked(primaryKey)
+	if rule == nil {
+		return
+	}
+	if bucket := rule.bucket(op); bucket != nil {
+		bucket.refill(time.Now())
+		bucket.tokens = math.Min(float64(bucket.limit.Burst), bucket.tokens+float64(n))
+	}
+}
@@ -0,0 +1,131 @@
+package numbergenerator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRewindNotConfirmed is returned by Rewind when it is called without ConfirmRewind.
+var ErrRewindNotConfirmed = errors.New("rewind must be confirmed with ConfirmRewind")
+
+// RewindOption configures a call to Rewind.
+type RewindOption func(*rewindConfig)
+
+type rewindConfig struct {
+	confirmed bool
+}
+
+// ConfirmRewind confirms that Rewind may reset records. Without it Rewind changes
+// nothing and returns ErrRewindNotConfirmed.
+func ConfirmRewind() RewindOption {
+	return func(cfg *rewindConfig) {
+		cfg.confirmed = true
+	}
+}
+
+// Rewind resets the status of every record of primaryKey after number back to
+// pending and moves the watermark back to number, so that the records are
+// processed again. Unlike deleting the key, the counter and the records are kept:
+// the next append continues after the last number issued. Rewinding to 0 resets
+// all records.
+//
+// Rewinding is destructive for consumers that already acted on the records, so it
+// must be confirmed with ConfirmRewind. Subscribers of Watch receive an
+// EventRewound.
+func (ng *NumberGenerator) Rewind(primaryKey string, number uint64, opts ...RewindOption) error {
+	return ng.rewind(stream{primaryKey: primaryKey}, number, opts)
+}
+
+func (ng *NumberGenerator) rewind(s stream, number uint64, opts []RewindOption) (err error) {
+	var cfg rewindConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.confirmed {
+		return ErrRewindNotConfirmed
+	}
+	if err := validateKey(s.primaryKey); err != nil {
+		return err
+	}
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+
+	defer ng.lockMutation(s)(&err)
+
+	m := Mutation{
+		Type:   MutationRewind,
+		Key:    s.primaryKey,
+		Group:  s.group,
+		Number: number,
+		Time:   time.Now(),
+	}
+	if err := ng.rewindLocked(s, m.Number, m.Time); err != nil {
+		return err
+	}
+	return ng.publish(m)
+}
+
+// rewindLocked resets the records after number to pending and moves the watermark
+// back to number. The caller must hold the stream's lock.
+func (ng *NumberGenerator) rewindLocked(s stream, number uint64, at time.Time) error {
+	total, err := ng.totalRecordsLocked(s)
+	if err != nil {
+		return err
+	}
+	if number > total {
+		return fmt.Errorf("cannot rewind %q to %d, it has %d records", s.cacheKey(), number, total)
+	}
+	if total == 0 {
+		return nil // Nothing was appended yet
+	}
+
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err
+	}
+	header, err := ng.readHeaderLocked(s)
+	if err != nil {
+		return err
+	}
+
+	ng.rewinds.Add(1) // Before any watermark moves back, see dependenciesMet
+	var reset []uint64
+	for n := number + 1; n <= total; n++ {
+		status, err := ng.statusLocked(s, n)
+		if err != nil {
+			return err
+		}
+		if status == 0 {
+			continue
+		}
+		if _, err := file.WriteAt([]byte{0}, headerSize+(int64(n)-1)*recordSize+8); err != nil {
+			return err
+		}
+		reset = append(reset, n)
+	}
+	if len(reset) > 0 {
+		if err := ng.setUpdatedAt(s, reset, at); err != nil {
+			return err
+		}
+	}
+
+	if header.LastUpdated > number {
+		header.LastUpdated = number
+		if err := writeAt(file, 0, &header); err != nil {
+			return err
+		}
+		ng.metrics.backlog.set(s, header)
+	}
+	if err := ng.syncFile(file); err != nil {
+		return err
+	}
+
+	if err := ng.rewindGlobalLocked(s, reset); err != nil {
+		return err
+	}
+
+	ng.notify(s, Event{Type: EventRewound, Number: number + 1, Watermark: header.LastUpdated, Time: at})
+	return nil
+}
@@ -0,0 +1,546 @@
+package numbergenerator
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	restoreDirName  = "restore.tmp" // Staging directory used by Restore
+	replacedDirName = "replaced"    // Directory in the staging directory holding the replaced data
+
+	keysArchiveDir     = "keys"
+	segmentsArchiveDir = "segments"
+	globalArchiveDir   = "global"
+)
+
+var encodedKeyPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Snapshot writes a tar archive of every key and, when configured WithSegments,
+// of the vmoformat segment files to w. The global log is included when the
+// generator was opened WithGlobalSequence. Appends and status updates continue while
+// the snapshot is taken: each stream file is copied under its lock, so every file
+// in the archive holds a header and exactly the records it counts, and the
+// segment files are captured together.
+//
+// Keys are archived under their encoded names independent of the fan-out, so an
+// archive can be restored into a generator with a different layout.
+func (ng *NumberGenerator) Snapshot(w io.Writer) error {
+	// Keep Restore out for the whole snapshot. The stream locks are taken directly
+	// below, as taking the barrier again could deadlock with a waiting Restore.
+	ng.barrier.RLock()
+	defer ng.barrier.RUnlock()
+
+	tw := tar.NewWriter(w)
+	err := ng.walkKeys(func(primaryKey, dir string) error {
+		return ng.snapshotKey(tw, primaryKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	if ng.segments != nil {
+		err := ng.segments.Snapshot(func(index int, size int64, r io.Reader) error {
+			return writeTarEntry(tw, fmt.Sprintf("%s/%d.vmo", segmentsArchiveDir, index), size, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The global log goes last: every record in the archive was stamped before it
+	// was copied, and the entries of records appended since then are voided when the
+	// archive is restored.
+	if ng.global != nil {
+		if err := ng.snapshotGlobalLog(tw); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// snapshotKey archives the key file and all streams of a primary key.
+func (ng *NumberGenerator) snapshotKey(tw *tar.Writer, primaryKey string) error {
+	dir := path.Join(keysArchiveDir, encodeKey(primaryKey))
+	if err := writeTarEntry(tw, path.Join(dir, keyFileName), int64(len(primaryKey)), strings.NewReader(primaryKey)); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(ng.buildFilePath(primaryKey)); err == nil {
+		if err := ng.snapshotStream(tw, stream{primaryKey: primaryKey}, path.Join(dir, "data.bin")); err != nil {
+			return err
+		}
+	}
+
+	groups, err := ng.Groups(primaryKey)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		name := path.Join(dir, groupsDir, group+groupFileExt)
+		if err := ng.snapshotStream(tw, stream{primaryKey: primaryKey, group: group}, name); err != nil {
+			return err
+		}
+	}
+
+	consumers, err := ng.Consumers(primaryKey)
+	if err != nil {
+		return err
+	}
+	for _, consumer := range consumers {
+		name := path.Join(dir, consumersDir, consumer+consumerFileExt)
+		if err := ng.snapshotConsumer(tw, stream{primaryKey: primaryKey}, consumer, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotConsumer archives the progress of a consumer group.
+func (ng *NumberGenerator) snapshotConsumer(tw *tar.Writer, s stream, consumer, name string) error {
+	lock := ng.streamLock(s)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := ng.openConsumerLocked(s, consumer, false)
+	if err != nil || file == nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, name, info.Size(), io.NewSectionReader(file, 0, info.Size()))
+}
+
+// snapshotStream archives the header of a stream and the records it counts,
+// followed by their times and dependencies. Data past the counted records, e.g. of an append that is
+// still in progress, is left out.
+func (ng *NumberGenerator) snapshotStream(tw *tar.Writer, s stream, name string) error {
+	lock := ng.streamLock(s)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var size int64
+	header := FileHeader{}
+	err = binary.Read(file, binary.BigEndian, &header)
+	switch {
+	case err == io.EOF:
+		// An empty file, nothing was appended yet.
+	case err != nil:
+		return err
+	default:
+		size = headerSize + int64(header.TotalRecords)*recordSize
+	}
+
+	if err := writeTarEntry(tw, name, size, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+	if err := ng.snapshotTimes(tw, s, header, strings.TrimSuffix(name, groupFileExt)+timesFileExt); err != nil {
+		return err
+	}
+	if err := ng.snapshotSeqs(tw, s, header, strings.TrimSuffix(name, groupFileExt)+seqFileExt); err != nil {
+		return err
+	}
+	return ng.snapshotDeps(tw, s, strings.TrimSuffix(name, groupFileExt)+depsFileExt)
+}
+
+// snapshotTimes archives the times of the records counted by header. The caller
+// must hold the stream's lock.
+func (ng *NumberGenerator) snapshotTimes(tw *tar.Writer, s stream, header FileHeader, name string) error {
+	timesFile, err := ng.ensureCachedFile(s, ng.buildTimesPath(s))
+	if os.IsNotExist(err) {
+		return nil // Written before times were tracked and opened read-only
+	}
+	if err != nil {
+		return err
+	}
+	info, err := timesFile.Stat()
+	if err != nil {
+		return err
+	}
+	timesLength := int64(header.TotalRecords) * timesSize
+	if info.Size() < timesLength {
+		timesLength = info.Size()
+	}
+	return writeTarEntry(tw, name, timesLength, io.NewSectionReader(timesFile, 0, timesLength))
+}
+
+// snapshotSeqs archives the global sequence numbers of the records counted by
+// header, if the stream has any. The caller must hold the stream's lock.
+func (ng *NumberGenerator) snapshotSeqs(tw *tar.Writer, s stream, header FileHeader, name string) error {
+	seqFile, err := os.Open(ng.buildSeqPath(s))
+	if os.IsNotExist(err) {
+		return nil // Appended without the global sequence
+	}
+	if err != nil {
+		return err
+	}
+	defer seqFile.Close()
+	info, err := seqFile.Stat()
+	if err != nil {
+		return err
+	}
+	length := int64(header.TotalRecords) * 8
+	if info.Size() < length {
+		length = info.Size()
+	}
+	return writeTarEntry(tw, name, length, io.NewSectionReader(seqFile, 0, length))
+}
+
+// snapshotGlobalLog archives the global log and the streams it refers to.
+func (ng *NumberGenerator) snapshotGlobalLog(tw *tar.Writer) error {
+	g := ng.global
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.log == nil {
+		return nil // Opened read-only before anything was stamped
+	}
+
+	info, err := g.streams.Stat()
+	if err != nil {
+		return err
+	}
+	name := path.Join(globalArchiveDir, globalStreamsFileName)
+	if err := writeTarEntry(tw, name, info.Size(), io.NewSectionReader(g.streams, 0, info.Size())); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &g.header); err != nil {
+		return err
+	}
+	size := int64(g.header.TotalRecords) * globalEntrySize
+	entries := io.NewSectionReader(g.log, headerSize, size)
+	return writeTarEntry(tw, path.Join(globalArchiveDir, globalLogFileName), headerSize+size, io.MultiReader(&buf, entries))
+}
+
+// snapshotDeps archives the dependencies file of a stream, if it has one. Lines
+// of records that were not counted are dropped when the file is loaded again. The
+// caller must hold the stream's lock.
+func (ng *NumberGenerator) snapshotDeps(tw *tar.Writer, s stream, name string) error {
+	depsFile, err := os.Open(ng.buildDepsPath(s))
+	if os.IsNotExist(err) {
+		return nil // No record of the stream has dependencies
+	}
+	if err != nil {
+		return err
+	}
+	defer depsFile.Close()
+	info, err := depsFile.Stat()
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, name, info.Size(), depsFile)
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// Restore replaces all keys, and the segment files when configured WithSegments,
+// with the contents of an archive written by Snapshot. All other operations wait
+// until the restore has finished. The archive is extracted to a staging directory
+// before anything is replaced, so a malformed archive leaves the data untouched.
+// The current keys and segment files are then swapped for the restored ones by
+// renames, and only deleted once every rename succeeded; a failed swap is undone.
+//
+// A successful restore is passed to the mutation hooks as a MutationRestore, so
+// replicas know to take a new snapshot.
+func (ng *NumberGenerator) Restore(r io.Reader) error {
+	if ng.readOnly {
+		return ErrReadOnly
+	}
+
+	ng.barrier.Lock()
+	err := ng.restoreLocked(r)
+	if err == nil {
+		err = ng.publish(Mutation{Type: MutationRestore, Time: time.Now()})
+	}
+	waits := ng.takeHookWaits(stream{})
+	ng.barrier.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return runHookWaits(waits)
+}
+
+// restoreLocked replaces the data with the archive in r. The caller must hold the
+// barrier for writing.
+func (ng *NumberGenerator) restoreLocked(r io.Reader) error {
+	staging := filepath.Join(ng.basePath, restoreDirName)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging) // Holds the replaced data after a successful swap
+
+	segments, err := extractArchive(r, staging)
+	if err != nil {
+		return fmt.Errorf("extracting snapshot: %w", err)
+	}
+
+	// Every handle refers to a file that is about to be replaced, so failures to
+	// close them are only logged.
+	_ = ng.CloseAllFiles()
+	if err := ng.closeGlobalLog(); err != nil {
+		ng.logger.Error("closing the global log", "error", err)
+	}
+	ng.dropDependencies()
+	ng.rewinds.Add(1) // Watermarks may move back, see dependenciesMet
+
+	// Keys, global log and segments are swapped as one: a failed rename undoes all
+	// of them, and the replaced files are only deleted with the staging directory.
+	sw := &swap{logger: ng.logger}
+	var replaced []string
+	swapAll := func(current []string, segmentPath func(index int) string) error {
+		var err error
+		replaced, err = ng.swapRestored(sw, staging)
+		if err == nil {
+			err = sw.moveSegments(filepath.Join(staging, replacedDirName, segmentsArchiveDir), current, segments, segmentPath)
+		}
+		if err != nil {
+			sw.undo()
+		}
+		return err
+	}
+	if ng.segments != nil {
+		err = ng.segments.Swap(swapAll)
+	} else {
+		err = swapAll(nil, nil)
+	}
+	if ng.global != nil {
+		// Reconciles the global log with the keys now in place.
+		if openErr := ng.openGlobalLog(); err == nil {
+			err = openErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range replaced {
+		ng.removeEmptyParents(dir)
+	}
+
+	if ng.stallDetector != nil {
+		ng.stallDetector.rescan.Store(true)
+	}
+	ng.metrics.backlog.reset()
+
+	// Intents of failed AppendMulti calls refer to the replaced data.
+	ng.dropFences()
+	return os.RemoveAll(filepath.Join(ng.basePath, intentsDirName))
+}
+
+// swapRestored moves the current key directories and global log aside into the
+// staging directory and the extracted ones into their place, and returns the
+// former locations of the replaced key directories. The caller must hold the
+// barrier for writing.
+func (ng *NumberGenerator) swapRestored(sw *swap, staging string) ([]string, error) {
+	replaced := filepath.Join(staging, replacedDirName)
+
+	var current []string
+	err := ng.walkKeys(func(primaryKey, dir string) error {
+		current = append(current, dir)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range current {
+		if err := sw.move(dir, filepath.Join(replaced, filepath.Base(dir))); err != nil {
+			return nil, err
+		}
+	}
+
+	restored, err := os.ReadDir(filepath.Join(staging, keysArchiveDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range restored {
+		dir := filepath.Join(staging, keysArchiveDir, entry.Name())
+		primaryKey, err := readKeyFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		if err := sw.move(dir, ng.buildKeyPath(primaryKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	if ng.global == nil {
+		return current, nil
+	}
+	// Without a global log in the archive an empty one is created when it is opened.
+	global := filepath.Join(ng.basePath, globalDirName)
+	if err := sw.move(global, filepath.Join(replaced, globalDirName)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := sw.move(filepath.Join(staging, globalArchiveDir), global); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return current, nil
+}
+
+// swap renames directories and remembers the renames, so they can be undone.
+type swap struct {
+	logger  *slog.Logger
+	renames []rename
+}
+
+type rename struct {
+	from, to string
+}
+
+// move renames from to to, creating the directories above to.
+func (sw *swap) move(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	sw.renames = append(sw.renames, rename{from: from, to: to})
+	return nil
+}
+
+// moveSegments moves the current segment files into dir and the restored ones into
+// the place of the segment with their index.
+func (sw *swap) moveSegments(dir string, current, restored []string, segmentPath func(index int) string) error {
+	for _, path := range current {
+		if err := sw.move(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+	for index, path := range restored {
+		if err := sw.move(path, segmentPath(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undo reverts the renames in reverse order. Failures are logged, as the data
+// then stays where it was moved to.
+func (sw *swap) undo() {
+	for i := len(sw.renames) - 1; i >= 0; i-- {
+		r := sw.renames[i]
+		err := os.MkdirAll(filepath.Dir(r.from), 0755)
+		if err == nil {
+			err = os.Rename(r.to, r.from)
+		}
+		if err != nil {
+			sw.logger.Error("undoing a file swap", "from", r.to, "to", r.from, "error", err)
+		}
+	}
+	sw.renames = nil
+}
+
+// extractArchive unpacks a snapshot into dir and returns the paths of the
+// extracted segment files in index order. Entry names are checked against the
+// layout written by Snapshot, so an archive cannot place files elsewhere.
+func extractArchive(r io.Reader, dir string) ([]string, error) {
+	segments := make(map[int]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+
+		parts := strings.Split(hdr.Name, "/")
+		switch {
+		case len(parts) == 2 && parts[0] == segmentsArchiveDir && strings.HasSuffix(parts[1], ".vmo"):
+			index, err := strconv.Atoi(strings.TrimSuffix(parts[1], ".vmo"))
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+			}
+			segments[index] = filepath.Join(dir, segmentsArchiveDir, parts[1])
+		case len(parts) == 3 && parts[0] == keysArchiveDir && encodedKeyPattern.MatchString(parts[1]) &&
+			(parts[2] == keyFileName || parts[2] == "data.bin" || parts[2] == "data"+timesFileExt || parts[2] == "data"+depsFileExt || parts[2] == "data"+seqFileExt):
+		case len(parts) == 4 && parts[0] == keysArchiveDir && encodedKeyPattern.MatchString(parts[1]) &&
+			parts[2] == groupsDir && validateGroupID(strings.TrimSuffix(path.Base(parts[3]), path.Ext(parts[3]))) == nil &&
+			(path.Ext(parts[3]) == groupFileExt || path.Ext(parts[3]) == timesFileExt || path.Ext(parts[3]) == depsFileExt || path.Ext(parts[3]) == seqFileExt):
+		case len(parts) == 4 && parts[0] == keysArchiveDir && encodedKeyPattern.MatchString(parts[1]) &&
+			parts[2] == consumersDir && path.Ext(parts[3]) == consumerFileExt &&
+			validateName("consumer name", strings.TrimSuffix(parts[3], consumerFileExt)) == nil:
+		case len(parts) == 2 && parts[0] == globalArchiveDir && (parts[1] == globalLogFileName || parts[1] == globalStreamsFileName):
+		default:
+			return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(file, tr)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Segment files are numbered consecutively from zero.
+	indexes := make([]int, 0, len(segments))
+	for index := range segments {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	paths := make([]string, len(indexes))
+	for i, index := range indexes {
+		if index != i {
+			return nil, fmt.Errorf("segment %d is missing from the snapshot", i)
+		}
+		paths[i] = segments[index]
+	}
+	return paths, nil
+}
@@ -0,0 +1,324 @@
+package numbergenerator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StallAlert reports a stream whose watermark has not advanced for longer than the
+// configured threshold while records above it are waiting.
+type StallAlert struct {
+	PrimaryKey   string        `json:"key"`
+	Group        string        `json:"group,omitempty"`
+	TotalRecords uint64        `json:"total_records"`
+	Watermark    uint64        `json:"watermark"`
+	Blocking     uint64        `json:"blocking"`    // Number the watermark waits for
+	Since        time.Time     `json:"since"`       // When the stream started waiting for Blocking
+	StalledFor   time.Duration `json:"stalled_for"` // Time between Since and the check
+
+	// Resolved is set on the follow-up alert sent once the watermark moved again or
+	// the stream caught up.
+	Resolved bool `json:"resolved"`
+}
+
+// AlertSink receives stall alerts. Sinks are called one after another from the
+// detector's goroutine, so a slow sink delays the next check.
+type AlertSink interface {
+	Alert(StallAlert) error
+}
+
+// AlertFunc lets an ordinary function be used as an AlertSink.
+type AlertFunc func(StallAlert) error
+
+// Alert calls f(alert).
+func (f AlertFunc) Alert(alert StallAlert) error {
+	return f(alert)
+}
+
+// LogSink writes alerts to logger, or to slog.Default() when it is nil. Stalls are
+// logged as warnings, their resolution as info.
+func LogSink(logger *slog.Logger) AlertSink {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return AlertFunc(func(alert StallAlert) error {
+		attrs := []any{"key", alert.PrimaryKey, "watermark", alert.Watermark, "total_records", alert.TotalRecords}
+		if alert.Group != "" {
+			attrs = append(attrs, "group", alert.Group)
+		}
+		if alert.Resolved {
+			logger.Info("stream no longer stalled", attrs...)
+		} else {
+			attrs = append(attrs, "blocking", alert.Blocking, "stalled_for", alert.StalledFor)
+			logger.Warn("stream stalled", attrs...)
+		}
+		return nil
+	})
+}
+
+// WebhookSink posts every alert as JSON to url. A nil client uses a client with a
+// 10 second timeout.
+func WebhookSink(url string, client *http.Client) AlertSink {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return AlertFunc(func(alert StallAlert) error {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook %s answered %s", url, resp.Status)
+		}
+		return nil
+	})
+}
+
+// StallDetectorConfig configures the stall detector started by WithStallDetector.
+type StallDetectorConfig struct {
+	// Threshold is how long a watermark may stay behind TotalRecords without moving
+	// before the stream is reported.
+	Threshold time.Duration
+
+	// Interval is how often the streams are checked, Threshold/4 by default.
+	Interval time.Duration
+
+	Sinks []AlertSink
+
+	// OnSinkError is called when a sink fails. Errors are logged to the
+	// generator's logger when it is nil.
+	OnSinkError func(sink AlertSink, alert StallAlert, err error)
+}
+
+// WithStallDetector starts a background goroutine that reports every stream whose
+// watermark has not advanced for cfg.Threshold while records above it exist. Each
+// stall is reported once, and once more with Resolved set when it ends. The
+// detector stops when the generator is closed.
+func WithStallDetector(cfg StallDetectorConfig) Option {
+	return func(ng *NumberGenerator) {
+		ng.stallConfig = &cfg
+	}
+}
+
+// stallDetector tracks the streams reported as stalled. Only streams that had
+// records above their watermark when they last changed are checked: every append,
+// status update and rewind marks its stream as a candidate, and a candidate is
+// dropped once a check finds it caught up. All streams are scanned once at start
+// and after a Restore, to find the streams that were behind already.
+type stallDetector struct {
+	ng      *NumberGenerator
+	cfg     StallDetectorConfig
+	stalled map[stream]StallAlert
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu         sync.Mutex
+	candidates map[stream]uint64 // Changes of the stream, so a check cannot drop one it did not see
+	rescan     atomic.Bool
+}
+
+func (ng *NumberGenerator) startStallDetector() error {
+	cfg := *ng.stallConfig
+	if cfg.Threshold <= 0 {
+		return fmt.Errorf("stall threshold must be positive, got %s", cfg.Threshold)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = cfg.Threshold / 4
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &stallDetector{
+		ng:         ng,
+		cfg:        cfg,
+		stalled:    make(map[stream]StallAlert),
+		cancel:     cancel,
+		candidates: make(map[stream]uint64),
+	}
+	d.rescan.Store(true)
+	d.wg.Add(1)
+	go d.run(ctx)
+	ng.stallDetector = d
+	return nil
+}
+
+// stop ends the detector and waits for a running check to finish.
+func (d *stallDetector) stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// touch marks a stream as changed, so the next check looks at it.
+func (d *stallDetector) touch(s stream) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.candidates[s]++
+}
+
+func (d *stallDetector) run(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.check(time.Now())
+		}
+	}
+}
+
+// check inspects the candidate streams once and alerts about stalls that began or
+// ended. A stream that cannot be read is logged and checked again next time.
+func (d *stallDetector) check(now time.Time) {
+	if d.rescan.Swap(false) {
+		err := d.ng.walkStreams(func(s stream) error {
+			d.touch(s)
+			return nil
+		})
+		if err != nil {
+			d.ng.logger.Error("scanning for stalled streams", "error", err)
+			d.rescan.Store(true)
+		}
+	}
+
+	d.mu.Lock()
+	candidates := make(map[stream]uint64, len(d.candidates))
+	for s, changes := range d.candidates {
+		candidates[s] = changes
+	}
+	d.mu.Unlock()
+
+	for s, changes := range candidates {
+		alert, stalled, err := d.ng.stallState(s, now, d.cfg.Threshold)
+		if err != nil {
+			d.ng.logger.Error("checking for a stalled stream", "key", s.primaryKey, "group", s.group, "error", err)
+			continue
+		}
+
+		previous, reported := d.stalled[s]
+		switch {
+		case stalled && (!reported || previous.Blocking != alert.Blocking):
+			if reported {
+				d.resolve(previous, alert)
+			}
+			d.stalled[s] = alert
+			d.dispatch(alert)
+		case !stalled && reported:
+			// Includes streams removed by Restore or Import.
+			delete(d.stalled, s)
+			d.resolve(previous, alert)
+		}
+
+		if alert.Blocking == 0 {
+			d.mu.Lock()
+			if d.candidates[s] == changes {
+				delete(d.candidates, s) // Caught up and not changed since
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// resolve sends the alert ending a reported stall, with the current state of the stream.
+func (d *stallDetector) resolve(previous, current StallAlert) {
+	previous.TotalRecords, previous.Watermark = current.TotalRecords, current.Watermark
+	previous.Resolved = true
+	d.dispatch(previous)
+}
+
+func (d *stallDetector) dispatch(alert StallAlert) {
+	for _, sink := range d.cfg.Sinks {
+		if err := sink.Alert(alert); err != nil {
+			if d.cfg.OnSinkError != nil {
+				d.cfg.OnSinkError(sink, alert, err)
+			} else {
+				d.ng.logger.Error("sending stall alert", "key", alert.PrimaryKey, "group", alert.Group, "error", err)
+			}
+		}
+	}
+}
+
+// stallState reports whether a stream is stalled at now. A stream waits for the
+// number after its watermark from the moment that record was appended or the
+// watermark last moved, whichever is later.
+func (ng *NumberGenerator) stallState(s stream, now time.Time, threshold time.Duration) (StallAlert, bool, error) {
+	defer ng.lockStream(s)()
+
+	alert := StallAlert{PrimaryKey: s.primaryKey, Group: s.group}
+	if _, err := os.Stat(ng.buildStreamPath(s)); os.IsNotExist(err) {
+		return alert, false, nil // Removed by Restore or Import
+	}
+	header, err := ng.readHeaderLocked(s)
+	if err == io.EOF {
+		return alert, false, nil // Nothing was appended yet
+	}
+	if err != nil {
+		return alert, false, err
+	}
+	alert.TotalRecords, alert.Watermark = header.TotalRecords, header.LastUpdated
+	if header.LastUpdated >= header.TotalRecords {
+		return alert, false, nil
+	}
+	alert.Blocking = header.LastUpdated + 1
+
+	blocking, err := ng.getTimes(s, alert.Blocking)
+	if err != nil {
+		return alert, false, err
+	}
+	since := blocking.AppendedAt
+	if header.LastUpdated > 0 {
+		watermark, err := ng.getTimes(s, header.LastUpdated)
+		if err != nil {
+			return alert, false, err
+		}
+		if watermark.UpdatedAt > since {
+			since = watermark.UpdatedAt
+		}
+	}
+	if since == 0 {
+		return alert, false, nil // Records from before times were tracked
+	}
+
+	alert.Since = time.Unix(0, since)
+	alert.StalledFor = now.Sub(alert.Since)
+	return alert, alert.StalledFor >= threshold, nil
+}
+
+// walkStreams calls fn for the default stream and every message group of all keys.
+func (ng *NumberGenerator) walkStreams(fn func(s stream) error) error {
+	return ng.walkKeys(func(primaryKey, dir string) error {
+		s := stream{primaryKey: primaryKey}
+		if _, err := os.Stat(ng.buildStreamPath(s)); err == nil {
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+
+		groups, err := ng.Groups(primaryKey)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := fn(stream{primaryKey: primaryKey, group: group}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
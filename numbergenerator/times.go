@@ -0,0 +1,95 @@
+package numbergenerator
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const timesFileExt = ".times"
+
+// recordTimes is the entry of a record in the times file kept next to every
+// stream file. Entries are indexed by record number like the records themselves;
+// records appended before times were tracked read as zero.
+type recordTimes struct {
+	AppendedAt int64 // Unix nanoseconds
+	UpdatedAt  int64 // Unix nanoseconds of the last status change, 0 if it never changed
+}
+
+var timesSize = int64(binary.Size(recordTimes{}))
+
+// buildTimesPath returns the times file of a stream, e.g. data.times next to data.bin.
+func (ng *NumberGenerator) buildTimesPath(s stream) string {
+	return strings.TrimSuffix(ng.buildStreamPath(s), groupFileExt) + timesFileExt
+}
+
+// setAppendedAt records when a record was appended. The caller must hold the stream's lock.
+func (ng *NumberGenerator) setAppendedAt(s stream, number uint64, at time.Time) error {
+	file, err := ng.ensureCachedFile(s, ng.buildTimesPath(s))
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek((int64(number)-1)*timesSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return binary.Write(file, binary.BigEndian, &recordTimes{AppendedAt: at.UnixNano()})
+}
+
+// setUpdatedAt records when the status of the given records changed. The caller
+// must hold the stream's lock.
+func (ng *NumberGenerator) setUpdatedAt(s stream, numbers []uint64, at time.Time) error {
+	file, err := ng.ensureCachedFile(s, ng.buildTimesPath(s))
+	if err != nil {
+		return err
+	}
+
+	for _, number := range numbers {
+		// Only overwrite the second field, AppendedAt stays as it is.
+		_, err = file.Seek((int64(number)-1)*timesSize+8, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(file, binary.BigEndian, at.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTimes returns the times of a record, or zero times if none were recorded.
+// The caller must hold the stream's lock.
+func (ng *NumberGenerator) getTimes(s stream, number uint64) (recordTimes, error) {
+	var times recordTimes
+
+	file, err := ng.openCachedFile(s, ng.buildTimesPath(s), false)
+	if os.IsNotExist(err) {
+		return times, nil // Reading does not create missing files
+	}
+	if err != nil {
+		return times, err
+	}
+
+	_, err = file.Seek((int64(number)-1)*timesSize, io.SeekStart)
+	if err != nil {
+		return times, err
+	}
+	err = binary.Read(file, binary.BigEndian, &times)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return recordTimes{}, nil
+	}
+	return times, err
+}
+
+// unixTime converts a recorded time back to a time.Time, returning nil for zero.
+func unixTime(nanos int64) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanos).UTC()
+	return &t
+}
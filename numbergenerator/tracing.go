@@ -0,0 +1,68 @@
+package numbergenerator
+
+import (
+	"context"
+)
+
+// Attribute is a key-value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{} // string, int64, uint64 or bool
+}
+
+// Tracer starts spans around ordering operations. It is deliberately small so
+// that any tracing library can be plugged in; the oteltrace package adapts an
+// OpenTelemetry tracer.
+type Tracer interface {
+	// Start begins a span as a child of the span in ctx and returns a context
+	// carrying the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// WithTracer traces AppendRecord, UpdateStatusIfMatch and WaitForTurn with t.
+// Pass the context of a message to the Context variants of these calls so their
+// spans become part of the message's trace. A nil t disables tracing.
+func WithTracer(t Tracer) Option {
+	return func(ng *NumberGenerator) {
+		if t == nil {
+			t = noopTracer{}
+		}
+		ng.tracer = t
+	}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+// startSpan begins a span about a stream.
+func (ng *NumberGenerator) startSpan(ctx context.Context, name string, s stream, attrs ...Attribute) (context.Context, Span) {
+	attrs = append(attrs, Attribute{"queueguard.key", s.primaryKey})
+	if s.group != "" {
+		attrs = append(attrs, Attribute{"queueguard.group", s.group})
+	}
+	return ng.tracer.Start(ctx, name, attrs...)
+}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
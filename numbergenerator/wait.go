@@ -0,0 +1,108 @@
+package numbergenerator
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned by calls waiting for the watermark when the generator is
+// closed while they wait.
+var ErrClosed = errors.New("number generator is closed")
+
+// waitBuffer is the event buffer of the subscriptions used to wait for the
+// watermark. Only watermark events matter, so a lagging subscription is simply renewed.
+const waitBuffer = 64
+
+// WaitForTurn blocks until it is number's turn in primaryKey, i.e. until the
+// watermark has reached number-1 and the streams the record depends on have
+// reached their numbers, or until ctx is done. It returns right away if all of
+// them are already there or beyond.
+func (ng *NumberGenerator) WaitForTurn(ctx context.Context, primaryKey string, number uint64) error {
+	return ng.waitForTurn(ctx, stream{primaryKey: primaryKey}, number)
+}
+
+func (ng *NumberGenerator) waitForTurn(ctx context.Context, s stream, number uint64) (err error) {
+	ctx, span := ng.startSpan(ctx, "queueguard.WaitForTurn", s, Attribute{"queueguard.number", number})
+	defer func() { endSpan(span, err) }()
+
+	watermark, err := ng.awaitTurn(ctx, s, "", number)
+	span.SetAttributes(Attribute{"queueguard.watermark", watermark})
+	return err
+}
+
+// awaitTurn waits until it is number's turn in a stream, or for its consumer group
+// consumer if set, and returns the watermark it saw last.
+func (ng *NumberGenerator) awaitTurn(ctx context.Context, s stream, consumer string, number uint64) (uint64, error) {
+	target := uint64(0)
+	if number > 0 {
+		target = number - 1
+	}
+	watermark, err := ng.waitForWatermark(ctx, s, consumer, target)
+	if err != nil {
+		return watermark, err
+	}
+
+	// Watermarks only move back on Rewind, so waiting for the dependencies one
+	// after another is enough for all of them to be met at the end.
+	deps, err := ng.dependencies(s, number)
+	if err != nil {
+		return watermark, err
+	}
+	for _, dep := range deps {
+		if _, err := ng.waitForWatermark(ctx, dep.stream(), dep.consumer(consumer), dep.Number); err != nil {
+			return watermark, err
+		}
+	}
+	return watermark, nil
+}
+
+// waitForWatermark blocks until the watermark of a stream, or of its consumer group
+// consumer if set, is at least target and returns the watermark it saw last.
+func (ng *NumberGenerator) waitForWatermark(ctx context.Context, s stream, consumer string, target uint64) (uint64, error) {
+	for {
+		reached, watermark, err := ng.waitOnce(ctx, s, consumer, target)
+		if err != nil || reached {
+			return watermark, err
+		}
+	}
+}
+
+// waitOnce subscribes to the stream and waits for the watermark to reach target.
+// It returns reached false if the subscription lagged and has to be renewed.
+func (ng *NumberGenerator) waitOnce(ctx context.Context, s stream, consumer string, target uint64) (reached bool, watermark uint64, err error) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before looking at the watermark, so no advance is missed in between.
+	events, err := ng.watch(watchCtx, s, []WatchOption{WatchBuffer(waitBuffer)})
+	if err != nil {
+		return false, 0, err
+	}
+	watermark, err = ng.watermark(s, consumer)
+	if err != nil {
+		return false, 0, err
+	}
+	if watermark >= target {
+		return true, watermark, nil
+	}
+
+	for e := range events {
+		if e.Consumer != consumer && e.Type != EventLagged {
+			continue
+		}
+		switch e.Type {
+		case EventWatermarkAdvanced:
+			watermark = e.Watermark
+			if watermark >= target {
+				return true, watermark, nil
+			}
+		case EventLagged:
+			return false, watermark, nil
+		}
+	}
+	// The channel is closed when ctx is done or the generator is closed.
+	if err := ctx.Err(); err != nil {
+		return false, watermark, err
+	}
+	return false, watermark, ErrClosed
+}
@@ -0,0 +1,274 @@
+package numbergenerator
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// EventType names a change reported by Watch.
+type EventType string
+
+const (
+	EventAppended          EventType = "appended"           // A record was appended
+	EventStatusChanged     EventType = "status_changed"     // A record was marked as done
+	EventWatermarkAdvanced EventType = "watermark_advanced" // The watermark moved up to Watermark
+	EventRewound           EventType = "rewound"            // Records from Number on were reset to pending, the watermark moved back to Watermark
+	EventImported          EventType = "imported"           // The stream was replaced by Import with Number records; resume with WatchFrom(1)
+
+	// EventLagged is the last event of a subscriber that did not keep up. Its
+	// Number is the first number the subscriber may have missed events for; the
+	// subscriber catches up by watching again with WatchFrom(Number).
+	EventLagged EventType = "lagged"
+)
+
+const defaultWatchBuffer = 1024
+
+// Event is a change to a watched stream.
+type Event struct {
+	Type       EventType
+	PrimaryKey string
+	Group      string // Empty for the key's default stream
+	Consumer   string // Consumer group whose progress changed, empty for changes of the stream itself
+	Number     uint64 // Record the event is about, unset for EventWatermarkAdvanced
+	Status     byte   // Status of the record after the change
+	Watermark  uint64 // Watermark after the change
+	Time       time.Time
+}
+
+// WatchOption configures a subscription created by Watch.
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	from   uint64
+	buffer int
+}
+
+// WatchFrom replays the stored state of every record from number on before
+// delivering live events: an EventAppended for each record, an EventStatusChanged
+// for each done record and an EventWatermarkAdvanced for the current watermark if it
+// is at least number. Status changes of records below number are only reflected by
+// the watermark.
+func WatchFrom(number uint64) WatchOption {
+	return func(cfg *watchConfig) {
+		cfg.from = number
+	}
+}
+
+// WatchBuffer sets how many undelivered events a subscriber may fall behind before
+// it receives EventLagged and its channel is closed. The default is 1024.
+func WatchBuffer(size int) WatchOption {
+	return func(cfg *watchConfig) {
+		cfg.buffer = size
+	}
+}
+
+// watcher is one subscription to a stream.
+type watcher struct {
+	ch     chan Event
+	done   chan struct{} // Closed with ch, ends the goroutine waiting for the context
+	closed bool
+}
+
+// send delivers an event without blocking. When only the slot reserved for
+// EventLagged is left, the subscriber is told where to resume and dropped. The
+// caller must hold ng.watchMu.
+func (w *watcher) send(e Event) bool {
+	if w.closed {
+		return false
+	}
+	if len(w.ch) < cap(w.ch)-1 {
+		w.ch <- e
+		return true
+	}
+	lagged := Event{Type: EventLagged, PrimaryKey: e.PrimaryKey, Group: e.Group, Number: e.Number, Watermark: e.Watermark, Time: e.Time}
+	if lagged.Number == 0 {
+		lagged.Number = e.Watermark // A missed watermark event is replayed from the watermark
+	}
+	w.ch <- lagged
+	w.close()
+	return false
+}
+
+func (w *watcher) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+		close(w.done)
+	}
+}
+
+// Watch returns a channel of the changes made to the default stream of
+// primaryKey: appends, status changes, watermark advances and rewinds, in the
+// order they were written. Progress of the key's consumer groups is reported with
+// the same event types and Consumer set. Events are delivered without blocking the writers; a subscriber
+// that falls too far behind receives EventLagged and its channel is closed. The
+// channel is also closed when ctx is done.
+func (ng *NumberGenerator) Watch(ctx context.Context, primaryKey string, opts ...WatchOption) (<-chan Event, error) {
+	return ng.watch(ctx, stream{primaryKey: primaryKey}, opts)
+}
+
+func (ng *NumberGenerator) watch(ctx context.Context, s stream, opts []WatchOption) (<-chan Event, error) {
+	if err := validateKey(s.primaryKey); err != nil {
+		return nil, err
+	}
+	cfg := watchConfig{buffer: defaultWatchBuffer}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.buffer < 2 {
+		return nil, fmt.Errorf("watch buffer must hold at least 2 events, got %d", cfg.buffer)
+	}
+
+	w := &watcher{ch: make(chan Event, cfg.buffer), done: make(chan struct{})}
+
+	// Replay and subscribe under the stream's lock, so no change falls in between.
+	unlock := ng.lockStream(s)
+	if cfg.from > 0 {
+		if err := ng.replayLocked(s, cfg.from, w); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	ng.watchMu.Lock()
+	if !w.closed {
+		if ng.watchers == nil {
+			ng.watchers = make(map[stream]map[*watcher]bool)
+		}
+		if ng.watchers[s] == nil {
+			ng.watchers[s] = make(map[*watcher]bool)
+		}
+		ng.watchers[s][w] = true
+	}
+	ng.watchMu.Unlock()
+	unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+			return // Lagged or closed with the generator, already unsubscribed
+		}
+		ng.watchMu.Lock()
+		defer ng.watchMu.Unlock()
+		ng.removeWatcherLocked(s, w)
+		w.close()
+	}()
+	return w.ch, nil
+}
+
+// replayLocked sends the stored state of the records from number on. The caller
+// must hold the stream's lock.
+func (ng *NumberGenerator) replayLocked(s stream, from uint64, w *watcher) error {
+	header, err := ng.readHeaderLocked(s)
+	if err == io.EOF || os.IsNotExist(err) {
+		return nil // Nothing was appended yet
+	}
+	if err != nil {
+		return err
+	}
+	if from > header.TotalRecords {
+		return nil
+	}
+
+	file, err := ng.ensureFileOpen(s)
+	if err != nil {
+		return err
+	}
+
+	ng.watchMu.Lock()
+	defer ng.watchMu.Unlock()
+
+	records := bufio.NewReader(io.NewSectionReader(file,
+		headerSize+int64(from-1)*recordSize, int64(header.TotalRecords-from+1)*recordSize))
+	for number := from; number <= header.TotalRecords; number++ {
+		var record NumberStatusFilename
+		if err := binary.Read(records, binary.BigEndian, &record); err != nil {
+			return err
+		}
+		times, err := ng.getTimes(s, number)
+		if err != nil {
+			return err
+		}
+
+		e := Event{Type: EventAppended, PrimaryKey: s.primaryKey, Group: s.group, Number: number, Status: record.Status, Watermark: header.LastUpdated}
+		if times.AppendedAt != 0 {
+			e.Time = time.Unix(0, times.AppendedAt)
+		}
+		if !w.send(e) {
+			return nil
+		}
+		if record.Status == 1 {
+			e.Type, e.Time = EventStatusChanged, time.Time{}
+			if times.UpdatedAt != 0 {
+				e.Time = time.Unix(0, times.UpdatedAt)
+			}
+			if !w.send(e) {
+				return nil
+			}
+		}
+	}
+
+	if header.LastUpdated >= from {
+		w.send(Event{Type: EventWatermarkAdvanced, PrimaryKey: s.primaryKey, Group: s.group, Watermark: header.LastUpdated})
+	}
+	return nil
+}
+
+// removeWatcherLocked unsubscribes w. The caller must hold ng.watchMu.
+func (ng *NumberGenerator) removeWatcherLocked(s stream, w *watcher) {
+	delete(ng.watchers[s], w)
+	if len(ng.watchers[s]) == 0 {
+		delete(ng.watchers, s)
+	}
+}
+
+// notify sends events to the subscribers of a stream. The caller must hold the
+// stream's lock, which keeps the events of a stream in order.
+func (ng *NumberGenerator) notify(s stream, events ...Event) {
+	if ng.stallDetector != nil {
+		ng.stallDetector.touch(s)
+	}
+
+	ng.watchMu.Lock()
+	defer ng.watchMu.Unlock()
+
+	for w := range ng.watchers[s] {
+		for _, e := range events {
+			e.PrimaryKey, e.Group = s.primaryKey, s.group
+			if !w.send(e) {
+				ng.removeWatcherLocked(s, w)
+				break
+			}
+		}
+	}
+}
+
+// notifyUpdate reports a status update that moved the watermark from previous to
+// watermark. The caller must hold the stream's lock.
+func (ng *NumberGenerator) notifyUpdate(s stream, numbers []uint64, previous, watermark uint64, at time.Time) {
+	events := make([]Event, 0, len(numbers)+1)
+	for _, number := range numbers {
+		events = append(events, Event{Type: EventStatusChanged, Number: number, Status: 1, Watermark: watermark, Time: at})
+	}
+	if watermark > previous {
+		events = append(events, Event{Type: EventWatermarkAdvanced, Watermark: watermark, Time: at})
+	}
+	ng.notify(s, events...)
+}
+
+// closeWatchers ends all subscriptions.
+func (ng *NumberGenerator) closeWatchers() {
+	ng.watchMu.Lock()
+	defer ng.watchMu.Unlock()
+	for _, watchers := range ng.watchers {
+		for w := range watchers {
+			w.close()
+		}
+	}
+	ng.watchers = nil
+}
@@ -0,0 +1,13 @@
+module queueguard/oteltrace
+
+go 1.21
+
+require (
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+	queueguard v0.0.0
+)
+
+require github.com/google/uuid v1.6.0 // indirect
+
+replace queueguard => ../
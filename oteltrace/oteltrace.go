@@ -0,0 +1,68 @@
+// Package oteltrace adapts an OpenTelemetry tracer to numbergenerator.Tracer. It
+// is a module of its own, queueguard/oteltrace, so that only programs requiring it
+// depend on OpenTelemetry.
+//
+//	ng, err := numbergenerator.NewNumberGenerator("./data",
+//		numbergenerator.WithTracer(oteltrace.New(otel.Tracer("queueguard"))))
+package oteltrace
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"queueguard/numbergenerator"
+)
+
+// New returns a numbergenerator.Tracer creating its spans with t.
+func New(t trace.Tracer) numbergenerator.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string, attrs ...numbergenerator.Attribute) (context.Context, numbergenerator.Span) {
+	ctx, span := t.t.Start(ctx, name, trace.WithAttributes(convert(attrs)...))
+	return ctx, spanAdapter{span}
+}
+
+type spanAdapter struct {
+	span trace.Span
+}
+
+func (s spanAdapter) SetAttributes(attrs ...numbergenerator.Attribute) {
+	s.span.SetAttributes(convert(attrs)...)
+}
+
+func (s spanAdapter) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s spanAdapter) End() {
+	s.span.End()
+}
+
+func convert(attrs []numbergenerator.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		switch v := attr.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(attr.Key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(attr.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(attr.Key, v))
+		case uint64:
+			kvs = append(kvs, attribute.Int64(attr.Key, int64(v)))
+		default:
+			kvs = append(kvs, attribute.String(attr.Key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,189 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"queueguard/numbergenerator"
+)
+
+const (
+	minRetryDelay = 50 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+)
+
+// Follower applies the mutations of a leader to its own NumberGenerator. The
+// follower's generator should not be written to by anything else.
+type Follower struct {
+	ng         *numbergenerator.NumberGenerator
+	leaderAddr string
+	done       chan struct{}
+	stopped    chan struct{}
+
+	mu       sync.Mutex
+	epoch    uint64 // Epoch of the leader the position refers to
+	position uint64 // Last position applied
+	conn     net.Conn
+	lastErr  error
+}
+
+// NewFollower starts replicating from the leader at leaderAddr into ng. It keeps
+// reconnecting until it is closed.
+func NewFollower(ng *numbergenerator.NumberGenerator, leaderAddr string) *Follower {
+	f := &Follower{
+		ng:         ng,
+		leaderAddr: leaderAddr,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// Position returns the last leader position applied by the follower.
+func (f *Follower) Position() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.position
+}
+
+// Err returns the error that broke the last connection to the leader, if any.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastErr
+}
+
+// Close disconnects from the leader and stops replicating.
+func (f *Follower) Close() error {
+	select {
+	case <-f.done:
+		return nil
+	default:
+	}
+	close(f.done)
+
+	f.mu.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+
+	<-f.stopped
+	return nil
+}
+
+func (f *Follower) run() {
+	defer close(f.stopped)
+
+	delay := minRetryDelay
+	for {
+		connected, err := f.replicate()
+		if connected {
+			delay = minRetryDelay // Only back off while the leader is unreachable
+		}
+
+		f.mu.Lock()
+		f.lastErr = err
+		f.mu.Unlock()
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// replicate runs one connection to the leader until it breaks. It reports
+// whether the leader could be reached at all.
+func (f *Follower) replicate() (bool, error) {
+	conn, err := net.DialTimeout("tcp", f.leaderAddr, maxRetryDelay)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		return true, nil
+	default:
+	}
+	f.conn = conn
+	epoch, position := f.epoch, f.position
+	f.mu.Unlock()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	var r io.Reader = conn // Holds what the decoder has not read yet
+	dec := json.NewDecoder(r)
+
+	send := func(msg message) error {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if err := send(message{Type: msgHello, Epoch: epoch, Position: position}); err != nil {
+		return true, err
+	}
+
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return true, err
+		}
+
+		switch msg.Type {
+		case msgSnapshot:
+			// The archive follows the message, after the newline ending it.
+			rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+			if b, err := rest.ReadByte(); err != nil {
+				return true, err
+			} else if b != '\n' {
+				return true, fmt.Errorf("unexpected byte %q before snapshot", b)
+			}
+			archive := &chunkReader{r: rest}
+			if err := f.ng.Restore(archive); err != nil {
+				return true, fmt.Errorf("restoring snapshot: %w", err)
+			}
+			// Restore may stop before the chunk ending the archive.
+			if _, err := io.Copy(io.Discard, archive); err != nil {
+				return true, fmt.Errorf("reading snapshot: %w", err)
+			}
+			r = rest
+			dec = json.NewDecoder(r)
+			epoch, position = msg.Epoch, msg.Position
+		case msgMutations:
+			if msg.Position != position {
+				return true, fmt.Errorf("leader sent mutations after %d, follower is at %d", msg.Position, position)
+			}
+			for _, e := range msg.Entries {
+				if err := f.ng.ApplyMutation(e.Mutation); err != nil {
+					return true, fmt.Errorf("applying mutation %d: %w", e.Seq, err)
+				}
+				position = e.Seq
+			}
+		default:
+			return true, fmt.Errorf("unexpected message %q", msg.Type)
+		}
+
+		f.mu.Lock()
+		f.epoch, f.position = epoch, position
+		f.mu.Unlock()
+
+		if err := send(message{Type: msgAck, Position: position}); err != nil {
+			return true, err
+		}
+	}
+}
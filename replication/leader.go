@@ -0,0 +1,363 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"queueguard/numbergenerator"
+)
+
+// AckMode selects when a mutation on the leader returns to its caller.
+type AckMode int
+
+const (
+	// Async returns as soon as the mutation is written on the leader. Followers
+	// catch up in the background.
+	Async AckMode = iota
+
+	// Sync returns once MinAcks followers have applied the mutation.
+	Sync
+)
+
+const maxBatch = 1000 // Mutations sent to a follower in one message
+
+// LeaderConfig configures a Leader.
+type LeaderConfig struct {
+	Addr       string        // TCP address to listen on, e.g. "127.0.0.1:7400"
+	AckMode    AckMode       // Async by default
+	MinAcks    int           // Followers that must acknowledge a mutation in Sync mode, 1 by default
+	AckTimeout time.Duration // How long Sync mutations wait for acknowledgements, 5s by default
+	LogSize    int           // Mutations kept for followers catching up, 100000 by default
+}
+
+// FollowerStatus describes a follower connected to the leader.
+type FollowerStatus struct {
+	Addr     string // Remote address of the follower
+	Position uint64 // Last position the follower acknowledged
+}
+
+// Leader ships the mutations of a NumberGenerator to connected followers.
+type Leader struct {
+	ng       *numbergenerator.NumberGenerator
+	cfg      LeaderConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	epoch     uint64  // Identifies the data positions refer to, new for every process and Restore
+	log       []entry // Retained mutations in position order
+	position  uint64  // Position of the last mutation
+	followers map[*follower]struct{}
+	changed   chan struct{} // Closed and replaced whenever the epoch, position or an acknowledgement moves
+	closed    bool
+}
+
+// follower is the leader's view of a connected follower.
+type follower struct {
+	conn  net.Conn
+	acked uint64
+}
+
+// NewLeader starts listening for followers and replicates every mutation made to
+// ng from now on. Followers that connect later receive a snapshot first.
+func NewLeader(ng *numbergenerator.NumberGenerator, cfg LeaderConfig) (*Leader, error) {
+	if cfg.MinAcks <= 0 {
+		cfg.MinAcks = 1
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = 5 * time.Second
+	}
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = 100000
+	}
+
+	epoch, err := newEpoch()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Leader{
+		ng:        ng,
+		cfg:       cfg,
+		listener:  listener,
+		epoch:     epoch,
+		followers: make(map[*follower]struct{}),
+		changed:   make(chan struct{}),
+	}
+	ng.AddMutationWaitHook(l.record)
+
+	l.wg.Add(1)
+	go l.accept()
+	return l, nil
+}
+
+// Addr returns the address the leader listens on.
+func (l *Leader) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Position returns the position of the last mutation recorded by the leader.
+func (l *Leader) Position() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.position
+}
+
+// Followers returns the connected followers and their acknowledged positions.
+func (l *Leader) Followers() []FollowerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]FollowerStatus, 0, len(l.followers))
+	for f := range l.followers {
+		statuses = append(statuses, FollowerStatus{Addr: f.conn.RemoteAddr().String(), Position: f.acked})
+	}
+	return statuses
+}
+
+// Close stops replication and disconnects all followers. Mutations made to the
+// generator afterwards are no longer replicated.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	for f := range l.followers {
+		f.conn.Close()
+	}
+	l.notifyLocked()
+	l.mu.Unlock()
+
+	err := l.listener.Close()
+	l.wg.Wait()
+	return err
+}
+
+// notifyLocked wakes everybody waiting for a change. l.mu must be held.
+func (l *Leader) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// newEpoch returns a random epoch, never 0, which followers start with.
+func newEpoch() (uint64, error) {
+	var epoch [8]byte
+	if _, err := rand.Read(epoch[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(epoch[:]) | 1, nil
+}
+
+// record is the mutation hook of the generator. It appends the mutation to the
+// log and, in Sync mode, has the caller wait for the followers to acknowledge it
+// once the stream is unlocked.
+func (l *Leader) record(m numbergenerator.Mutation) (func() error, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, nil
+	}
+	if m.Type == numbergenerator.MutationRestore {
+		// The logged mutations no longer lead to the restored data. A new epoch
+		// makes every follower take a snapshot of it.
+		defer l.mu.Unlock()
+		epoch, err := newEpoch()
+		if err != nil {
+			return nil, err
+		}
+		l.epoch, l.log = epoch, nil
+		l.notifyLocked()
+		return nil, nil
+	}
+	l.position++
+	seq := l.position
+	l.log = append(l.log, entry{Seq: seq, Mutation: m})
+	if len(l.log) > l.cfg.LogSize+l.cfg.LogSize/4 {
+		// Trim in chunks so that appending stays cheap.
+		l.log = append([]entry(nil), l.log[len(l.log)-l.cfg.LogSize:]...)
+	}
+	l.notifyLocked()
+	l.mu.Unlock()
+
+	if l.cfg.AckMode == Sync {
+		return func() error { return l.waitForAcks(seq) }, nil
+	}
+	return nil, nil
+}
+
+func (l *Leader) waitForAcks(seq uint64) error {
+	timeout := time.NewTimer(l.cfg.AckTimeout)
+	defer timeout.Stop()
+
+	for {
+		l.mu.Lock()
+		acks := 0
+		for f := range l.followers {
+			if f.acked >= seq {
+				acks++
+			}
+		}
+		changed, closed := l.changed, l.closed
+		l.mu.Unlock()
+
+		if acks >= l.cfg.MinAcks {
+			return nil
+		}
+		if closed {
+			return ErrClosed
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return ErrAckTimeout
+		}
+	}
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return // The listener was closed
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.serve(conn)
+		}()
+	}
+}
+
+// serve streams the log to one follower until the connection breaks.
+func (l *Leader) serve(conn net.Conn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+
+	var hello message
+	if err := dec.Decode(&hello); err != nil || hello.Type != msgHello {
+		return
+	}
+
+	f := &follower{conn: conn}
+	epoch, position := hello.Epoch, hello.Position
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	needSnapshot := epoch != l.epoch
+	if !needSnapshot {
+		f.acked = position
+	}
+	l.followers[f] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.followers, f)
+		l.notifyLocked()
+		l.mu.Unlock()
+	}()
+
+	// Acknowledgements arrive independently of what is being sent.
+	go func() {
+		for {
+			var ack message
+			if err := dec.Decode(&ack); err != nil {
+				conn.Close()
+				return
+			}
+			if ack.Type == msgAck {
+				l.mu.Lock()
+				f.acked = ack.Position
+				l.notifyLocked()
+				l.mu.Unlock()
+			}
+		}
+	}()
+
+	for {
+		if needSnapshot {
+			var err error
+			if epoch, position, err = l.sendSnapshot(enc, w); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+			needSnapshot = false
+		}
+
+		l.mu.Lock()
+		for position >= l.position && epoch == l.epoch && !l.closed {
+			changed := l.changed
+			l.mu.Unlock()
+			<-changed
+			l.mu.Lock()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		if epoch != l.epoch || len(l.log) == 0 || l.log[0].Seq > position+1 {
+			// The data was restored, or the follower is behind the retained log.
+			l.mu.Unlock()
+			needSnapshot = true
+			continue
+		}
+		start := int(position + 1 - l.log[0].Seq)
+		end := start + maxBatch
+		if end > len(l.log) {
+			end = len(l.log)
+		}
+		batch := append([]entry(nil), l.log[start:end]...)
+		l.mu.Unlock()
+
+		if err := enc.Encode(message{Type: msgMutations, Position: position, Entries: batch}); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		position = batch[len(batch)-1].Seq
+	}
+}
+
+// sendSnapshot sends the full state of the generator and returns the epoch and
+// position it corresponds to. Mutations are written to disk before they enter
+// the log, so the snapshot contains at least everything up to the position;
+// replaying later mutations that it happens to contain as well is harmless. The
+// archive is streamed in chunks after the message, see chunkWriter.
+func (l *Leader) sendSnapshot(enc *json.Encoder, w io.Writer) (uint64, uint64, error) {
+	// A Restore after this point starts a new epoch, and the follower receives
+	// another snapshot.
+	l.mu.Lock()
+	epoch, position := l.epoch, l.position
+	l.mu.Unlock()
+
+	if err := enc.Encode(message{Type: msgSnapshot, Epoch: epoch, Position: position}); err != nil {
+		return 0, 0, err
+	}
+	chunks := &chunkWriter{w: w}
+	if err := l.ng.Snapshot(chunks); err != nil {
+		return 0, 0, err
+	}
+	return epoch, position, chunks.Close()
+}
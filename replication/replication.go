@@ -0,0 +1,116 @@
+// Package replication ships the mutations of a leader NumberGenerator to
+// followers over TCP, so that the sequence state survives the loss of a node.
+//
+// Followers connect to the leader and report the epoch and position they have
+// applied. The leader answers with the mutations after that position, or with a
+// full snapshot when the follower is too far behind or was replicating from a
+// previous leader process. Followers acknowledge every batch they applied; in
+// Sync mode the leader holds each mutation until enough followers acknowledged it.
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"queueguard/numbergenerator"
+)
+
+// Message types of the wire protocol. Every message is a JSON object on its own line.
+const (
+	msgHello     = "hello"     // Follower -> leader: epoch and position applied so far
+	msgSnapshot  = "snapshot"  // Leader -> follower: full state as of a position, followed by the archive in chunks
+	msgMutations = "mutations" // Leader -> follower: mutations following a position
+	msgAck       = "ack"       // Follower -> leader: position applied
+)
+
+var (
+	// ErrAckTimeout is returned by mutations on a Sync leader when not enough
+	// followers acknowledged them in time. The mutation is kept on the leader and
+	// still reaches the followers once they catch up.
+	ErrAckTimeout = errors.New("replication: timed out waiting for follower acknowledgements")
+
+	// ErrClosed is returned by mutations waiting for acknowledgements when the
+	// leader is closed.
+	ErrClosed = errors.New("replication: leader closed")
+)
+
+type message struct {
+	Type     string  `json:"type"`
+	Epoch    uint64  `json:"epoch,omitempty"`
+	Position uint64  `json:"position"`
+	Entries  []entry `json:"entries,omitempty"`
+}
+
+// entry is a mutation together with its position in the leader's log.
+type entry struct {
+	Seq      uint64                   `json:"seq"`
+	Mutation numbergenerator.Mutation `json:"mutation"`
+}
+
+// maxChunk bounds the chunks a follower accepts, so a corrupt length cannot make it
+// allocate without limit.
+const maxChunk = 1 << 20
+
+// chunkWriter frames a stream of unknown length, e.g. a snapshot archive, as
+// chunks with an 8-byte length prefix. Close writes the empty chunk ending it.
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err := binary.Write(cw.w, binary.BigEndian, uint64(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := cw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) Close() error {
+	return binary.Write(cw.w, binary.BigEndian, uint64(0))
+}
+
+// chunkReader reads a stream written by a chunkWriter and returns io.EOF after
+// its last chunk.
+type chunkReader struct {
+	r         io.Reader
+	remaining uint64 // Bytes left in the current chunk
+	done      bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.remaining == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(cr.r, binary.BigEndian, &cr.remaining); err != nil {
+			return 0, err
+		}
+		if cr.remaining > maxChunk {
+			return 0, fmt.Errorf("chunk of %d bytes exceeds %d", cr.remaining, maxChunk)
+		}
+		cr.done = cr.remaining == 0
+	}
+	if uint64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,213 @@
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"queueguard/numbergenerator"
+)
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newGenerator opens a NumberGenerator in a temporary directory.
+func newGenerator(t *testing.T) *numbergenerator.NumberGenerator {
+	t.Helper()
+	ng, err := numbergenerator.NewNumberGenerator(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewNumberGenerator failed: %v", err)
+	}
+	return ng
+}
+
+func TestSyncReplicationToTwoFollowers(t *testing.T) {
+	leaderNG := newGenerator(t)
+	defer leaderNG.Close()
+	leader, err := NewLeader(leaderNG, LeaderConfig{Addr: "127.0.0.1:0", AckMode: Sync, MinAcks: 2})
+	if err != nil {
+		t.Fatalf("NewLeader failed: %v", err)
+	}
+	defer leader.Close()
+
+	var followers []*Follower
+	var followerNGs []*numbergenerator.NumberGenerator
+	for i := 0; i < 2; i++ {
+		ng := newGenerator(t)
+		defer ng.Close()
+		f := NewFollower(ng, leader.Addr().String())
+		defer f.Close()
+		followers = append(followers, f)
+		followerNGs = append(followerNGs, ng)
+	}
+	waitFor(t, "followers to connect", func() bool { return len(leader.Followers()) == 2 })
+
+	for i := 0; i < 10; i++ {
+		if _, err := leaderNG.AppendRecord("orders", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	group, _ := leaderNG.Group("orders", "eu")
+	if _, err := group.AppendRecord(0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+	if err := leaderNG.UpdateStatuses("orders", []uint64{1, 2, 3}); err != nil {
+		t.Fatalf("UpdateStatuses failed: %v", err)
+	}
+
+	// In Sync mode every follower has applied the mutations once they returned.
+	want, _ := leaderNG.GetFilename("orders", 7)
+	for i, ng := range followerNGs {
+		if position := followers[i].Position(); position != leader.Position() {
+			t.Errorf("follower %d is at %d, leader at %d", i, position, leader.Position())
+		}
+		if last, err := ng.GetLastNumber("orders"); err != nil || last != 10 {
+			t.Errorf("follower %d: GetLastNumber = %d, %v", i, last, err)
+		}
+		if last, err := ng.GetLastUpdateNumber("orders"); err != nil || last != 3 {
+			t.Errorf("follower %d: GetLastUpdateNumber = %d, %v", i, last, err)
+		}
+		if got, _ := ng.GetFilename("orders", 7); got != want {
+			t.Errorf("follower %d: filename %q, want %q", i, got, want)
+		}
+		g, _ := ng.Group("orders", "eu")
+		if last, err := g.GetLastNumber(); err != nil || last != 1 {
+			t.Errorf("follower %d: group GetLastNumber = %d, %v", i, last, err)
+		}
+	}
+}
+
+func TestAsyncFollowerCatchesUpFromSnapshot(t *testing.T) {
+	leaderNG := newGenerator(t)
+	defer leaderNG.Close()
+	leader, err := NewLeader(leaderNG, LeaderConfig{Addr: "127.0.0.1:0", LogSize: 4})
+	if err != nil {
+		t.Fatalf("NewLeader failed: %v", err)
+	}
+	defer leader.Close()
+
+	// Written before the follower exists and beyond the retained log.
+	for i := 0; i < 20; i++ {
+		if _, err := leaderNG.AppendRecord("orders", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+
+	ng := newGenerator(t)
+	defer ng.Close()
+	f := NewFollower(ng, leader.Addr().String())
+	defer f.Close()
+	waitFor(t, "the follower to catch up", func() bool { return f.Position() == leader.Position() })
+
+	for i := 0; i < 5; i++ {
+		if _, err := leaderNG.AppendRecord("orders", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	waitFor(t, "the follower to apply new appends", func() bool { return f.Position() == leader.Position() })
+
+	if last, err := ng.GetLastNumber("orders"); err != nil || last != 25 {
+		t.Errorf("GetLastNumber = %d, %v", last, err)
+	}
+	statuses := leader.Followers()
+	if len(statuses) != 1 || statuses[0].Position != leader.Position() {
+		t.Errorf("unexpected follower statuses %+v", statuses)
+	}
+}
+
+func TestFollowerResyncsAfterLeaderRestore(t *testing.T) {
+	leaderNG := newGenerator(t)
+	defer leaderNG.Close()
+	leader, err := NewLeader(leaderNG, LeaderConfig{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("NewLeader failed: %v", err)
+	}
+	defer leader.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := leaderNG.AppendRecord("orders", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+
+	ng := newGenerator(t)
+	defer ng.Close()
+	f := NewFollower(ng, leader.Addr().String())
+	defer f.Close()
+	waitFor(t, "the follower to catch up", func() bool {
+		last, _ := ng.GetLastNumber("orders")
+		return last == 10
+	})
+
+	// Restoring a snapshot with other data is not a mutation followers can apply.
+	other := newGenerator(t)
+	defer other.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := other.AppendRecord("invoices", 0); err != nil {
+			t.Fatalf("AppendRecord failed: %v", err)
+		}
+	}
+	var snapshot bytes.Buffer
+	if err := other.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := leaderNG.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	waitFor(t, "the follower to take the restored data", func() bool {
+		last, _ := ng.GetLastNumber("invoices")
+		return last == 3
+	})
+	if last, _ := ng.GetLastNumber("orders"); last != 0 {
+		t.Errorf("orders GetLastNumber = %d after the restore, want 0", last)
+	}
+
+	if _, err := leaderNG.AppendRecord("invoices", 0); err != nil {
+		t.Fatalf("AppendRecord failed: %v", err)
+	}
+	waitFor(t, "the follower to apply new appends", func() bool {
+		last, _ := ng.GetLastNumber("invoices")
+		return last == 4
+	})
+	if err := f.Err(); err != nil {
+		t.Errorf("the follower lost its connection: %v", err)
+	}
+}
+
+func TestSyncWaitReleasesTheStream(t *testing.T) {
+	leaderNG := newGenerator(t)
+	defer leaderNG.Close()
+	leader, err := NewLeader(leaderNG, LeaderConfig{Addr: "127.0.0.1:0", AckMode: Sync, AckTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("NewLeader failed: %v", err)
+	}
+	defer leader.Close()
+
+	// Without followers the append waits for the timeout, but only after the
+	// record was written and the stream unlocked.
+	done := make(chan error, 1)
+	go func() {
+		_, err := leaderNG.AppendRecord("orders", 0)
+		done <- err
+	}()
+	waitFor(t, "the append to be recorded", func() bool { return leader.Position() == 1 })
+	start := time.Now()
+	if last, err := leaderNG.GetLastNumber("orders"); err != nil || last != 1 {
+		t.Errorf("GetLastNumber = %d, %v", last, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetLastNumber waited %s for the acknowledgements", elapsed)
+	}
+	if err := <-done; !errors.Is(err, ErrAckTimeout) {
+		t.Errorf("expected ErrAckTimeout, got %v", err)
+	}
+}
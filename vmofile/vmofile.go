@@ -4,8 +4,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
+
+	"queueguard/metrics"
 )
 
 const maxRecords = 1000000
@@ -26,6 +31,10 @@ type Record struct {
 type VMOFiles struct {
 	Files    []*VMOFile
 	BasePath string
+	mu       sync.Mutex // Serialises access to Files and their contents
+
+	fsyncLatency *metrics.Histogram // Set by SetMetrics
+	logger       *slog.Logger       // Set by SetLogger
 }
 
 type VMOFile struct {
@@ -33,23 +42,73 @@ type VMOFile struct {
 	Body     map[string]*Record
 	FilePath string
 	File     *os.File // Add a file pointer
+
+	fsyncLatency *metrics.Histogram
 }
 
 func NewVMOFiles(basePath string) (*VMOFiles, error) {
 	files := &VMOFiles{
 		BasePath: basePath,
+		logger:   slog.Default(),
 	}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// SetLogger sets the logger used for errors that cannot be returned, e.g. when
+// closing replaced segment files. slog.Default() is used otherwise.
+func (files *VMOFiles) SetLogger(logger *slog.Logger) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	if logger != nil {
+		files.logger = logger
+	}
+}
+
+// SetMetrics registers the metrics of the segment files with reg:
+//
+//	vmo_fsync_duration_seconds  fsync latency of segment files
+//	vmo_records                 records across all segments
+//	vmo_segments                number of segment files
+func (files *VMOFiles) SetMetrics(reg *metrics.Registry) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
+	files.fsyncLatency = reg.NewHistogram("vmo_fsync_duration_seconds", "Time taken to fsync VMO segment files.", nil)
+	for _, file := range files.Files {
+		file.fsyncLatency = files.fsyncLatency
+	}
+	reg.NewGaugeFunc("vmo_records", "Records across all VMO segment files.", func() float64 {
+		return float64(files.GetTotalRecords())
+	})
+	reg.NewGaugeFunc("vmo_segments", "Number of VMO segment files.", func() float64 {
+		files.mu.Lock()
+		defer files.mu.Unlock()
+		return float64(len(files.Files))
+	})
+}
+
+// segmentPath returns the path of the segment file with the given index.
+func (files *VMOFiles) segmentPath(index int) string {
+	return fmt.Sprintf("%s_%d.vmo", files.BasePath, index)
+}
+
+// load opens all segment files of BasePath, creating the first one if there is none.
+func (files *VMOFiles) load() error {
+	files.Files = nil
 
 	fileIndex := 0
 	for {
-		filePath := fmt.Sprintf("%s_%d.vmo", basePath, fileIndex)
+		filePath := files.segmentPath(fileIndex)
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
 			break
 		}
 
 		vmoFile, err := loadVMOFile(filePath)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		files.Files = append(files.Files, vmoFile)
@@ -57,14 +116,60 @@ func NewVMOFiles(basePath string) (*VMOFiles, error) {
 	}
 
 	if len(files.Files) == 0 {
-		newFile, err := createNewVMOFile(fmt.Sprintf("%s_%d.vmo", basePath, 0))
+		newFile, err := createNewVMOFile(files.segmentPath(0))
 		if err != nil {
-			return nil, err
+			return err
 		}
 		files.Files = append(files.Files, newFile)
 	}
 
-	return files, nil
+	for _, file := range files.Files {
+		file.fsyncLatency = files.fsyncLatency
+	}
+	return nil
+}
+
+// Snapshot calls fn with the contents of every segment file in index order.
+// Writers are blocked until it returns, so all segments are captured at the same moment.
+func (files *VMOFiles) Snapshot(fn func(index int, size int64, r io.Reader) error) error {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
+	for index, file := range files.Files {
+		info, err := file.File.Stat()
+		if err != nil {
+			return err
+		}
+		if err := fn(index, info.Size(), io.NewSectionReader(file.File, 0, info.Size())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swap calls fn to replace the segment files, e.g. by renaming other files into
+// their place, and then loads the segments found afterwards. fn receives the paths
+// of the current segment files in index order and the path the segment with a
+// given index is loaded from. Writers are blocked until Swap returns. If fn fails,
+// it must have put the previous files back: they are kept open and used as before.
+func (files *VMOFiles) Swap(fn func(current []string, segmentPath func(index int) string) error) error {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
+	current := make([]string, 0, len(files.Files))
+	for _, file := range files.Files {
+		current = append(current, file.FilePath)
+	}
+	if err := fn(current, files.segmentPath); err != nil {
+		return err
+	}
+
+	for _, file := range files.Files {
+		if err := file.File.Close(); err != nil {
+			files.logger.Error("closing replaced segment", "path", file.FilePath, "error", err)
+		}
+	}
+	return files.load()
 }
 
 func loadVMOFile(filePath string) (*VMOFile, error) {
@@ -138,24 +243,30 @@ func (files *VMOFiles) findRecordByMD5(md5Hash [16]byte) (*Record, *VMOFile) {
 	return nil, nil // Record not found
 }
 
-func (f *VMOFiles) AddRecord(md5Hash [16]byte) {
+// AddRecord appends a record for md5Hash to the current segment, starting a new
+// segment once the current one holds maxRecords records.
+func (f *VMOFiles) AddRecord(md5Hash [16]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	currentFile := f.Files[len(f.Files)-1] // Current file is the last one
 	if currentFile.Header.RecordsCount >= maxRecords {
 		// Create new file
 		newFilePath := fmt.Sprintf("%s_%d.vmo", f.BasePath, len(f.Files))
 		newFile, err := createNewVMOFile(newFilePath)
 		if err != nil {
-			panic(err) // Simplification for example
+			return fmt.Errorf("creating segment %s: %w", newFilePath, err)
 		}
+		newFile.fsyncLatency = f.fsyncLatency
 		f.Files = append(f.Files, newFile)
 		currentFile = newFile
 	}
 
-	currentFile.AddRecord(md5Hash)
+	return currentFile.AddRecord(md5Hash)
 }
 
 // Modify AddRecord to use the existing file handler for appending new records
-func (f *VMOFile) AddRecord(md5Hash [16]byte) {
+func (f *VMOFile) AddRecord(md5Hash [16]byte) error {
 	now := uint64(time.Now().Unix())
 	hashString := fmt.Sprintf("%x", md5Hash)
 
@@ -167,66 +278,84 @@ func (f *VMOFile) AddRecord(md5Hash [16]byte) {
 	}
 	f.Body[hashString] = record
 	f.Header.RecordsCount++
-	f.appendRecordToFile(record) // Append only this new record to the file
 
+	// Append only this new record to the file
+	if err := f.appendRecordToFile(record); err != nil {
+		// Revert the in-memory state so it keeps matching the file header
+		delete(f.Body, hashString)
+		f.Header.RecordsCount--
+		return fmt.Errorf("adding record to %s: %w", f.FilePath, err)
+	}
+	return nil
 }
 
 // This method appends a single new record using the existing file handler
-func (f *VMOFile) appendRecordToFile(record *Record) {
+func (f *VMOFile) appendRecordToFile(record *Record) error {
 	// Seek to the end of the file
-	_, err := f.File.Seek(0, 2) // 2 refers to os.SEEK_END
+	_, err := f.File.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic(err) // Simplification for example purposes
+		return err
 	}
 
 	err = binary.Write(f.File, binary.LittleEndian, record)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	f.File.Sync()
+	return f.sync()
 }
 
 // Update an existing record using the existing file handler
-func (f *VMOFile) updateRecord(hashString string, now uint64) {
+func (f *VMOFile) updateRecord(hashString string, now uint64) error {
 	record := f.Body[hashString]
 	record.LastUpdated = now // Assume we're just updating the LastUpdated field for simplicity
 
 	// Calculate the offset in the file where the record should be
 	offset := int64(binary.Size(f.Header)) + int64(binary.Size(Record{}))*int64(record.TotalCount-1)
-	_, err := f.File.Seek(offset, 0) // 0 refers to os.SEEK_SET
+	_, err := f.File.Seek(offset, io.SeekStart)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(f.File, binary.LittleEndian, record)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Consider if you want to sync after each record update
-	f.File.Sync()
+	return f.sync()
 }
 
 // Update only the header using the existing file handler
-func (f *VMOFile) updateHeader() {
+func (f *VMOFile) updateHeader() error {
 	// Seek to the beginning of the file to overwrite the header
-	_, err := f.File.Seek(0, 0) // 0 refers to os.SEEK_SET
+	_, err := f.File.Seek(0, io.SeekStart)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = binary.Write(f.File, binary.LittleEndian, &f.Header)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Flush the header changes to disk
-	f.File.Sync()
+	return f.sync()
+}
+
+// sync flushes the file to disk and records how long it took.
+func (f *VMOFile) sync() error {
+	start := time.Now()
+	err := f.File.Sync()
+	f.fsyncLatency.ObserveSince(start)
+	return err
 }
 
 // GetTotalCount returns the total count for a given MD5 hash across all VMO files.
 func (files *VMOFiles) GetTotalCount(md5Hash [16]byte) (uint32, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
 	record, _ := files.findRecordByMD5(md5Hash)
 	if record != nil {
 		return record.TotalCount, nil
@@ -236,6 +365,9 @@ func (files *VMOFiles) GetTotalCount(md5Hash [16]byte) (uint32, error) {
 
 // GetLastNumber returns the last number for a given MD5 hash across all VMO files.
 func (files *VMOFiles) GetLastNumber(md5Hash [16]byte) (uint32, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
 	record, _ := files.findRecordByMD5(md5Hash)
 	if record != nil {
 		return record.LastNumber, nil
@@ -245,6 +377,9 @@ func (files *VMOFiles) GetLastNumber(md5Hash [16]byte) (uint32, error) {
 
 // GetLastUpdate returns the last update time for a given MD5 hash across all VMO files.
 func (files *VMOFiles) GetLastUpdate(md5Hash [16]byte) (uint64, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
 	record, _ := files.findRecordByMD5(md5Hash)
 	if record != nil {
 		return record.LastUpdated, nil
@@ -254,6 +389,9 @@ func (files *VMOFiles) GetLastUpdate(md5Hash [16]byte) (uint64, error) {
 
 // SetLastNumber sets the last number for a given MD5 hash across all VMO files.
 func (files *VMOFiles) SetLastNumber(md5Hash [16]byte, lastNumber uint32) error {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
 	record, file := files.findRecordByMD5(md5Hash)
 	if record != nil {
 		// Update the record's LastNumber
@@ -283,14 +421,16 @@ func (files *VMOFiles) SetLastNumber(md5Hash [16]byte, lastNumber uint32) error
 			return err                        // Return the error if writing fails
 		}
 
-		file.File.Sync()
-		return nil // Successfully updated the record
+		return file.sync() // Successfully updated the record once it is on disk
 	}
 	return errors.New("record not found") // MD5 hash not found in any file
 }
 
 // GetTotalRecords returns the total number of records across all VMO files.
 func (files *VMOFiles) GetTotalRecords() uint32 {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
 	var totalRecords uint32 = 0
 	for _, file := range files.Files {
 		totalRecords += file.Header.RecordsCount